@@ -2,35 +2,122 @@ package main
 
 import (
 	"fmt"
+	"github.com/cortezaproject/corteza-discovery-searcher/searcher"
 	"github.com/cortezaproject/corteza-server/pkg/options"
 	_ "github.com/joho/godotenv/autoload"
 	"os"
 	"strings"
+	"time"
 )
 
 type (
 	config struct {
 		httpAddr string
-		es       struct {
-			addresses []string
-		}
-		cortezaHttp  string
-		cortezaAuth  string
-		jwtSecret    []byte
-		clientKey    string
-		clientSecret string
+		http     struct {
+			readTimeout       time.Duration
+			readHeaderTimeout time.Duration
+			writeTimeout      time.Duration
+			idleTimeout       time.Duration
+			maxHeaderBytes    int
+
+			// how long to wait for in-flight requests on shutdown
+			shutdownTimeout time.Duration
+
+			// HTTPS; client certificates are verified when client CA is set
+			tlsCert           string
+			tlsKey            string
+			tlsClientCA       string
+			tlsClientOptional bool
+		}
+
+		// elasticsearch or embedded
+		backend string
+		es      searcher.EsOptions
+
+		// auto, elasticsearch or opensearch
+		esFlavour string
+
+		// keyword field with document ID
+		esTiebreaker string
+		embedded     struct {
+			documents string
+		}
+		corteza searcher.ApiOptions
+		jwt     searcher.JwtOptions
+
+		protectedRoles []string
+		metadataRoles  []string
+
+		metadataCacheTTL time.Duration
+
+		highlightPreTag  string
+		highlightPostTag string
+
+		omitUnconfiguredRecords bool
+		requireAuth             bool
+
+		introspection         bool
+		introspectionCacheTTL time.Duration
+
+		tracing            bool
+		tracingSampleRatio float64
 	}
 )
 
+const (
+	backendElasticsearch = "elasticsearch"
+	backendEmbedded      = "embedded"
+)
+
 const (
 	discoverySearcher  = "DISCOVERY_SEARCHER_"
 	envKeyHttpAddr     = discoverySearcher + "HTTP_ADDR"
+	envKeyHttpRead     = discoverySearcher + "HTTP_READ_TIMEOUT"
+	envKeyHttpReadHdr  = discoverySearcher + "HTTP_READ_HEADER_TIMEOUT"
+	envKeyHttpWrite    = discoverySearcher + "HTTP_WRITE_TIMEOUT"
+	envKeyHttpIdle     = discoverySearcher + "HTTP_IDLE_TIMEOUT"
+	envKeyHttpMaxHdr   = discoverySearcher + "HTTP_MAX_HEADER_BYTES"
+	envKeyHttpShutdown = discoverySearcher + "HTTP_SHUTDOWN_TIMEOUT"
+	envKeyHttpTlsCert  = discoverySearcher + "HTTP_TLS_CERT"
+	envKeyHttpTlsKey   = discoverySearcher + "HTTP_TLS_KEY"
+	envKeyHttpClientCA = discoverySearcher + "HTTP_TLS_CLIENT_CA"
+	envKeyHttpClientOp = discoverySearcher + "HTTP_TLS_CLIENT_CERT_OPTIONAL"
 	envKeyEsAddr       = discoverySearcher + "ES_ADDRESS"
+	envKeyEsFlavour    = discoverySearcher + "ES_FLAVOUR"
+	envKeyEsTiebreaker = discoverySearcher + "ES_SORT_TIEBREAKER"
+	envKeyEsUsername   = discoverySearcher + "ES_USERNAME"
+	envKeyEsPassword   = discoverySearcher + "ES_PASSWORD"
+	envKeyEsApiKey     = discoverySearcher + "ES_API_KEY"
+	envKeyEsCloudID    = discoverySearcher + "ES_CLOUD_ID"
+	envKeyEsCACert     = discoverySearcher + "ES_CA_CERT"
+	envKeyEsClientCert = discoverySearcher + "ES_CLIENT_CERT"
+	envKeyEsClientKey  = discoverySearcher + "ES_CLIENT_KEY"
+	envKeyEsCertFinger = discoverySearcher + "ES_CERT_FINGERPRINT"
+	envKeyBackend      = discoverySearcher + "BACKEND"
+	envKeyEmbeddedDocs = discoverySearcher + "EMBEDDED_DOCUMENTS"
 	envKeyBaseUrl      = discoverySearcher + "CORTEZA_SERVER_BASE_URL"
 	envKeyAuthUrl      = discoverySearcher + "CORTEZA_SERVER_AUTH_URL"
 	envKeyJwtSecret    = discoverySearcher + "CORTEZA_SERVER_JWT_SECRET"
+	envKeyJwksUrl      = discoverySearcher + "JWT_JWKS_URL"
+	envKeyJwksRefresh  = discoverySearcher + "JWT_JWKS_REFRESH"
+	envKeyJwtPubKeys   = discoverySearcher + "JWT_PUBLIC_KEYS"
+	envKeyJwtIssuer    = discoverySearcher + "JWT_ISSUER"
+	envKeyJwtAudience  = discoverySearcher + "JWT_AUDIENCE"
 	envKeyClientKey    = discoverySearcher + "CORTEZA_SERVER_CLIENT_KEY"
 	envKeyClientSecret = discoverySearcher + "CORTEZA_SERVER_CLIENT_SECRET"
+	envKeyApiTimeout   = discoverySearcher + "CORTEZA_SERVER_TIMEOUT"
+	envKeyTokenMargin  = discoverySearcher + "CORTEZA_SERVER_TOKEN_REFRESH_MARGIN"
+	envKeyProtRoles    = discoverySearcher + "PROTECTED_ROLES"
+	envKeyMetaRoles    = discoverySearcher + "METADATA_INVALIDATE_ROLES"
+	envKeyMetaCacheTTL = discoverySearcher + "METADATA_CACHE_TTL"
+	envKeyHlPreTag     = discoverySearcher + "HIGHLIGHT_PRE_TAG"
+	envKeyHlPostTag    = discoverySearcher + "HIGHLIGHT_POST_TAG"
+	envKeyOmitUnconf   = discoverySearcher + "OMIT_UNCONFIGURED_RECORDS"
+	envKeyRequireAuth  = discoverySearcher + "REQUIRE_AUTH"
+	envKeyIntrospect   = discoverySearcher + "TOKEN_INTROSPECTION"
+	envKeyIntroCache   = discoverySearcher + "TOKEN_INTROSPECTION_CACHE_TTL"
+	envKeyTracing      = discoverySearcher + "TRACING"
+	envKeyTracingRatio = discoverySearcher + "TRACING_SAMPLE_RATIO"
 )
 
 func getConfig() (*config, error) {
@@ -38,36 +125,125 @@ func getConfig() (*config, error) {
 
 	return c, func() error {
 
-		c.cortezaHttp = options.EnvString(envKeyBaseUrl, "http://server:80")
-		if c.cortezaHttp == "" {
+		c.corteza.BaseURL = options.EnvString(envKeyBaseUrl, "http://server:80")
+		if c.corteza.BaseURL == "" {
 			return fmt.Errorf("endpoint URL for corteza (%s) is empty or missing", envKeyAuthUrl)
 		}
 
 		c.httpAddr = options.EnvString(envKeyHttpAddr, "127.0.0.1:3101")
+		c.http.readTimeout = options.EnvDuration(envKeyHttpRead, 30*time.Second)
+		c.http.readHeaderTimeout = options.EnvDuration(envKeyHttpReadHdr, 10*time.Second)
+		c.http.writeTimeout = options.EnvDuration(envKeyHttpWrite, time.Minute)
+		c.http.idleTimeout = options.EnvDuration(envKeyHttpIdle, 2*time.Minute)
+		c.http.shutdownTimeout = options.EnvDuration(envKeyHttpShutdown, 30*time.Second)
+		if c.http.maxHeaderBytes = options.EnvInt(envKeyHttpMaxHdr, 1<<20); c.http.maxHeaderBytes <= 0 {
+			return fmt.Errorf("max header size (%s) must be positive", envKeyHttpMaxHdr)
+		}
+
+		c.http.tlsCert = os.Getenv(envKeyHttpTlsCert)
+		c.http.tlsKey = os.Getenv(envKeyHttpTlsKey)
+		c.http.tlsClientCA = os.Getenv(envKeyHttpClientCA)
+		c.http.tlsClientOptional = options.EnvBool(envKeyHttpClientOp, false)
+
+		if (c.http.tlsCert == "") != (c.http.tlsKey == "") {
+			return fmt.Errorf("both certificate (%s) and key (%s) are required for HTTPS", envKeyHttpTlsCert, envKeyHttpTlsKey)
+		}
+
+		if c.http.tlsClientCA != "" && c.http.tlsCert == "" {
+			return fmt.Errorf("client certificate verification (%s) requires HTTPS (%s)", envKeyHttpClientCA, envKeyHttpTlsCert)
+		}
 
-		c.cortezaAuth = options.EnvString(envKeyAuthUrl, c.cortezaHttp+"/auth")
-		if c.cortezaAuth == "" {
+		c.corteza.AuthURL = options.EnvString(envKeyAuthUrl, c.corteza.BaseURL+"/auth")
+		if c.corteza.AuthURL == "" {
 			return fmt.Errorf("endpoint URL for corteza auth (%s) is empty or missing", envKeyAuthUrl)
 		}
 
 		if tmp := os.Getenv(envKeyJwtSecret); tmp != "" {
-			c.jwtSecret = []byte(tmp)
+			c.jwt.Secret = []byte(tmp)
 		}
 
-		if c.clientKey = os.Getenv(envKeyClientKey); c.clientKey == "" {
+		c.jwt.JwksURL = os.Getenv(envKeyJwksUrl)
+		c.jwt.JwksRefresh = options.EnvDuration(envKeyJwksRefresh, time.Hour)
+		c.jwt.PublicKeyFiles = strings.Fields(os.Getenv(envKeyJwtPubKeys))
+		c.jwt.Issuer = os.Getenv(envKeyJwtIssuer)
+		c.jwt.Audience = strings.Fields(os.Getenv(envKeyJwtAudience))
+
+		if c.corteza.ClientKey = os.Getenv(envKeyClientKey); c.corteza.ClientKey == "" {
 			return fmt.Errorf("client key (%s) is empty or missing", envKeyClientKey)
 		}
 
-		if c.clientSecret = os.Getenv(envKeyClientSecret); c.clientSecret == "" {
+		if c.corteza.ClientSecret = os.Getenv(envKeyClientSecret); c.corteza.ClientSecret == "" {
 			return fmt.Errorf("client secret (%s) is empty or missing", envKeyClientSecret)
 		}
 
+		if c.corteza.Timeout = options.EnvDuration(envKeyApiTimeout, 30*time.Second); c.corteza.Timeout <= 0 {
+			return fmt.Errorf("corteza server request timeout (%s) must be positive", envKeyApiTimeout)
+		}
+
+		c.corteza.TokenRefreshMargin = options.EnvDuration(envKeyTokenMargin, time.Minute)
+
+		switch c.backend = options.EnvString(envKeyBackend, backendElasticsearch); c.backend {
+		case backendElasticsearch:
+		case backendEmbedded:
+			if c.embedded.documents = os.Getenv(envKeyEmbeddedDocs); c.embedded.documents == "" {
+				return fmt.Errorf("documents file for embedded backend (%s) is empty or missing", envKeyEmbeddedDocs)
+			}
+		default:
+			return fmt.Errorf("unknown backend (%s): %q", envKeyBackend, c.backend)
+		}
+
+		switch c.esFlavour = options.EnvString(envKeyEsFlavour, searcher.EngineAuto); c.esFlavour {
+		case searcher.EngineAuto, searcher.EngineElasticsearch, searcher.EngineOpenSearch:
+		default:
+			return fmt.Errorf("unknown search engine flavour (%s): %q", envKeyEsFlavour, c.esFlavour)
+		}
+
+		if c.esTiebreaker = options.EnvString(envKeyEsTiebreaker, "_id"); c.esTiebreaker == "" {
+			return fmt.Errorf("sort tiebreaker (%s) is empty", envKeyEsTiebreaker)
+		}
+
+		c.es.Username = os.Getenv(envKeyEsUsername)
+		c.es.Password = os.Getenv(envKeyEsPassword)
+		c.es.APIKey = os.Getenv(envKeyEsApiKey)
+		c.es.CloudID = os.Getenv(envKeyEsCloudID)
+		c.es.CACertFile = os.Getenv(envKeyEsCACert)
+		c.es.ClientCertFile = os.Getenv(envKeyEsClientCert)
+		c.es.ClientKeyFile = os.Getenv(envKeyEsClientKey)
+		c.es.CertFingerprint = os.Getenv(envKeyEsCertFinger)
+
+		if (c.es.ClientCertFile == "") != (c.es.ClientKeyFile == "") {
+			return fmt.Errorf("both client certificate (%s) and key (%s) are required for mutual TLS", envKeyEsClientCert, envKeyEsClientKey)
+		}
+
 		for _, a := range strings.Split(options.EnvString(envKeyEsAddr, "http://localhost:9200"), " ") {
 			if a = strings.TrimSpace(a); a != "" {
-				c.es.addresses = append(c.es.addresses, a)
+				c.es.Addresses = append(c.es.Addresses, a)
 			}
 		}
 
+		c.protectedRoles = strings.Fields(options.EnvString(envKeyProtRoles, ""))
+		c.metadataRoles = strings.Fields(options.EnvString(envKeyMetaRoles, strings.Join(c.protectedRoles, " ")))
+
+		if c.metadataCacheTTL = options.EnvDuration(envKeyMetaCacheTTL, 5*time.Minute); c.metadataCacheTTL <= 0 {
+			return fmt.Errorf("metadata cache TTL (%s) must be positive", envKeyMetaCacheTTL)
+		}
+
+		c.highlightPreTag = options.EnvString(envKeyHlPreTag, "<em>")
+		c.highlightPostTag = options.EnvString(envKeyHlPostTag, "</em>")
+		c.omitUnconfiguredRecords = options.EnvBool(envKeyOmitUnconf, false)
+		c.requireAuth = options.EnvBool(envKeyRequireAuth, false)
+		if c.requireAuth && len(c.jwt.Secret) == 0 && c.jwt.JwksURL == "" && len(c.jwt.PublicKeyFiles) == 0 {
+			return fmt.Errorf("authentication is required (%s) but JWT secret or keys are not set", envKeyRequireAuth)
+		}
+
+		c.introspection = options.EnvBool(envKeyIntrospect, false)
+		c.introspectionCacheTTL = options.EnvDuration(envKeyIntroCache, 30*time.Second)
+
+		c.tracing = options.EnvBool(envKeyTracing, false)
+		if c.tracingSampleRatio = float64(options.EnvFloat32(envKeyTracingRatio, 1)); c.tracingSampleRatio < 0 || c.tracingSampleRatio > 1 {
+			return fmt.Errorf("trace sample ratio (%s) must be between 0 and 1", envKeyTracingRatio)
+		}
+
 		return nil
 	}()
 }
@@ -6,14 +6,13 @@ import (
 	"github.com/cortezaproject/corteza-discovery-searcher/searcher"
 	"github.com/cortezaproject/corteza-server/pkg/cli"
 	"github.com/cortezaproject/corteza-server/pkg/logger"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
-	"github.com/go-chi/jwtauth"
 	"go.uber.org/zap"
 	"net"
 	"net/http"
+	"time"
 )
 
 func main() {
@@ -23,53 +22,144 @@ func main() {
 	log := logger.MakeDebugLogger().WithOptions(zap.AddStacktrace(zap.PanicLevel))
 	ctx := cli.Context()
 
-	api, err := searcher.ApiClient(cfg.cortezaHttp, cfg.cortezaAuth, cfg.clientKey, cfg.clientSecret)
+	if cfg.tracing {
+		shutdown, err := searcher.InitTracing(ctx, searcher.TracingOptions{
+			ServiceName: "corteza-discovery-searcher",
+			SampleRatio: cfg.tracingSampleRatio,
+		})
+		cli.HandleError(err)
+
+		defer func() {
+			// flush spans of the requests that were drained on shutdown
+			sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := shutdown(sctx); err != nil {
+				log.Warn("could not flush traces", zap.Error(err))
+			}
+		}()
+	}
+
+	api, err := searcher.ApiClient(cfg.corteza)
 	cli.HandleError(err)
 
-	esc, err := searcher.EsClient(cfg.es.addresses)
+	var backend searcher.Backend
+	switch cfg.backend {
+	case backendEmbedded:
+		backend, err = searcher.EmbeddedBackend(log, cfg.embedded.documents, cfg.esTiebreaker)
+		cli.HandleError(err)
+
+	default:
+		esc, err := searcher.EsClient(cfg.es)
+		cli.HandleError(err)
+		esb := searcher.EsBackend(log, esc, cfg.esFlavour, cfg.esTiebreaker)
+		if err = esb.Detect(ctx); err != nil {
+			log.Warn("search engine detection failed, retrying on healthcheck", zap.Error(err))
+		}
+
+		backend = esb
+	}
+
+	meta := searcher.MetadataCache(log, api, cfg.metadataCacheTTL)
+	go meta.Watch(ctx)
+
+	jwtv, err := searcher.JwtVerifier(log, cfg.jwt)
 	cli.HandleError(err)
+	go jwtv.Watch(ctx)
 
-	StartHttpServer(ctx, log, cfg.httpAddr, func() http.Handler {
+	err = StartHttpServer(ctx, log, cfg, func() http.Handler {
 		router := chi.NewRouter()
 		router.Use(handleCORS)
 		router.Use(middleware.StripSlashes)
 		router.Use(middleware.RealIP)
 		router.Use(middleware.RequestID)
 
-		if len(cfg.jwtSecret) == 0 {
-			log.Warn(fmt.Sprintf("JWT secret not set (%s), access to private indexes disabled", envKeyJwtSecret))
+		if !jwtv.Enabled() {
+			log.Warn(fmt.Sprintf("JWT secret (%s) or keys (%s, %s) not set, access to private indexes disabled", envKeyJwtSecret, envKeyJwksUrl, envKeyJwtPubKeys))
 		} else {
-			router.Use(jwtauth.Verifier(jwtauth.New(jwt.SigningMethodHS512.Alg(), cfg.jwtSecret, nil)))
+			router.Use(jwtv.Verifier)
+
+			if cfg.introspection {
+				router.Use(searcher.TokenIntrospector(log, api, cfg.introspectionCacheTTL).Introspect)
+			}
 		}
 
-		// @todo If we want to prevent any kind of anonymous access
-		//router.Use(jwtauth.Authenticator)
+		searcher.Handlers(router, log, backend, api, meta, searcher.Options{
+			ProtectedRoles:   cfg.protectedRoles,
+			MetadataRoles:    cfg.metadataRoles,
+			HighlightPreTag:  cfg.highlightPreTag,
+			HighlightPostTag: cfg.highlightPostTag,
 
-		searcher.Handlers(router, log, esc, api)
+			OmitUnconfiguredRecords: cfg.omitUnconfiguredRecords,
+			RequireAuth:             cfg.requireAuth,
+		})
 
 		return router
 	}())
+
+	cli.HandleError(err)
 }
 
-func StartHttpServer(ctx context.Context, log *zap.Logger, addr string, h http.Handler) {
+// StartHttpServer serves requests until context is done or server fails
+//
+// On context cancellation server stops accepting new connections
+// and waits (up to the shutdown timeout) for in-flight requests.
+func StartHttpServer(ctx context.Context, log *zap.Logger, cfg *config, h http.Handler) error {
+	tlsConfig, err := serverTLSConfig(ctx, log, cfg)
+	if err != nil {
+		return err
+	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", cfg.httpAddr)
 	if err != nil {
-		log.Error("cannot start server", zap.Error(err))
-		return
+		return fmt.Errorf("cannot start server: %w", err)
 	}
 
+	srv := &http.Server{
+		Handler:           h,
+		ReadTimeout:       cfg.http.readTimeout,
+		ReadHeaderTimeout: cfg.http.readHeaderTimeout,
+		WriteTimeout:      cfg.http.writeTimeout,
+		IdleTimeout:       cfg.http.idleTimeout,
+		MaxHeaderBytes:    cfg.http.maxHeaderBytes,
+		TLSConfig:         tlsConfig,
+
+		// Not using ctx; in-flight requests should not
+		// be canceled when shutdown starts
+		BaseContext: func(listener net.Listener) context.Context {
+			return context.Background()
+		},
+	}
+
+	served := make(chan error, 1)
 	go func() {
-		srv := http.Server{
-			Handler: h,
-			BaseContext: func(listener net.Listener) context.Context {
-				return ctx
-			},
+		log.Info("http server started", zap.String("addr", cfg.httpAddr), zap.Bool("tls", tlsConfig != nil))
+		if tlsConfig != nil {
+			// certificate is provided by the TLS config
+			served <- srv.ServeTLS(listener, "", "")
+		} else {
+			served <- srv.Serve(listener)
 		}
-		log.Info("http server started", zap.String("addr", addr))
-		err = srv.Serve(listener)
 	}()
-	<-ctx.Done()
+
+	select {
+	case err = <-served:
+		return fmt.Errorf("http server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	log.Info("shutting down http server", zap.Duration("timeout", cfg.http.shutdownTimeout))
+
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.http.shutdownTimeout)
+	defer cancel()
+
+	if err = srv.Shutdown(sctx); err != nil {
+		_ = srv.Close()
+		return fmt.Errorf("http server shutdown: %w", err)
+	}
+
+	log.Info("http server stopped")
+	return nil
 }
 
 // Sets up default CORS rules to use as a middleware
@@ -0,0 +1,137 @@
+package searcher
+
+import (
+	"context"
+	"github.com/go-chi/jwtauth"
+	"strconv"
+	"strings"
+)
+
+type (
+	// accessTier determines the set of indexes and the
+	// discovery meta result configuration used for the request
+	accessTier int
+)
+
+const (
+	// anonymous users (missing, invalid or expired access token)
+	tierPublic accessTier = iota
+
+	// authenticated users
+	tierPrivate
+
+	// authenticated users with one of the protected roles
+	tierProtected
+)
+
+// String returns name of the tier as used in the module's discovery meta
+func (t accessTier) String() string {
+	switch t {
+	case tierPrivate:
+		return "private"
+	case tierProtected:
+		return "protected"
+	default:
+		return "public"
+	}
+}
+
+// indexPrefix returns prefix of the indexes that can be searched
+//
+// Protected tier uses the private indexes; documents there are
+// guarded by the role filters
+func (t accessTier) indexPrefix() string {
+	if t == tierPublic {
+		return "corteza-public-"
+	}
+
+	return "corteza-private-"
+}
+
+// accessTierFor resolves the access tier from the JWT claims in the context
+func accessTierFor(ctx context.Context, protectedRoles []string) accessTier {
+	userID, roles := identity(ctx)
+	if userID == 0 {
+		return tierPublic
+	}
+
+	for _, r := range roles {
+		for _, pr := range protectedRoles {
+			if r == pr {
+				return tierProtected
+			}
+		}
+	}
+
+	return tierPrivate
+}
+
+// identity extracts user ID and roles from the JWT claims in the context
+//
+// Roles are expected to be a space delimited string (as issued by Corteza)
+// but a list of strings is accepted as well.
+func identity(ctx context.Context) (userID uint64, roles []string) {
+	_, claims, _ := jwtauth.FromContext(ctx)
+
+	switch rr := claims["roles"].(type) {
+	case string:
+		roles = strings.Fields(rr)
+	case []interface{}:
+		for _, r := range rr {
+			if r, is := r.(string); is && r != "" {
+				roles = append(roles, r)
+			}
+		}
+	}
+
+	if sub, is := claims["sub"].(string); is {
+		userID, _ = strconv.ParseUint(sub, 10, 64)
+	}
+
+	return
+}
+
+// hasAnyRole checks if any of the roles is in the required list
+//
+// Empty required list is always satisfied
+func hasAnyRole(roles, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+
+	for _, r := range roles {
+		for _, rr := range required {
+			if r == rr {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowedRolesFilter skips all documents that do not have
+// bearing roles in the allow list
+//
+// With no roles nothing from the private index matches.
+func allowedRolesFilter(roles []string) map[string]interface{} {
+	if roles == nil {
+		roles = []string{}
+	}
+
+	return map[string]interface{}{
+		"terms": map[string][]string{"security.allowedRoles": roles},
+	}
+}
+
+// deniedRolesFilter skips all documents that have
+// bearing roles in the deny list
+func deniedRolesFilter(roles []string) map[string]interface{} {
+	if roles == nil {
+		roles = []string{}
+	}
+
+	return map[string]interface{}{
+		"terms": map[string][]string{"security.deniedRoles": roles},
+	}
+}
@@ -1,8 +1,16 @@
 package searcher
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
 type (
@@ -24,6 +32,25 @@ type (
 		Key   interface{} `json:"key"`
 		Count int         `json:"doc_count"`
 	}
+
+	// corteza discovery aggregation results
+	cdAggregateResult struct {
+		Type  string `json:"type"`
+		Field string `json:"field"`
+
+		// range
+		Min *float64 `json:"min,omitempty"`
+		Max *float64 `json:"max,omitempty"`
+
+		// cardinality
+		Count *int64 `json:"count,omitempty"`
+
+		// composite & date histogram
+		Buckets []*Bucket `json:"buckets,omitempty"`
+
+		// composite, cursor for the next page of buckets
+		After string `json:"after,omitempty"`
+	}
 )
 
 // @todo: Import/export for esSearch structs
@@ -37,8 +64,10 @@ func (t Aggregations) encodeTerms(aggregations []string) (res EsSearchAggrTerms)
 	return
 }
 
-// RangeAggregate returns the min- and max-value for a specific field in a specific index
-func RangeAggregate(index, doctype string, query map[string]interface{}, field string) (float64, float64, error) {
+// RangeAggregate returns the min- and max-value for a specific field
+//
+// Both are nil when no document has a value in the field
+func RangeAggregate(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, query interface{}, field string) (*float64, *float64, error) {
 	request := map[string]interface{}{
 		"size": 0,
 		"aggs": map[string]interface{}{
@@ -58,27 +87,29 @@ func RangeAggregate(index, doctype string, query map[string]interface{}, field s
 		request["query"] = query
 	}
 
-	// call search
-
 	result := struct {
 		Aggregations map[string]struct {
-			Value float64 `json:"value"`
+			Value *float64 `json:"value"`
 		} `json:"aggregations"`
 	}{}
 
+	if err := execSearch(ctx, esc, log, request, &result); err != nil {
+		return nil, nil, err
+	}
+
 	if result.Aggregations == nil {
-		return 0, 0, fmt.Errorf("no aggregation result found")
+		return nil, nil, fmt.Errorf("no aggregation result found")
 	}
 	minValue, ok1 := result.Aggregations["min_"+field]
 	maxValue, ok2 := result.Aggregations["max_"+field]
 	if !ok1 || !ok2 {
-		return 0, 0, errors.New("min or max value not a number")
+		return nil, nil, errors.New("min or max value not a number")
 	}
 	return minValue.Value, maxValue.Value, nil
 }
 
-// CardinalityAggregate returns the unique count of a specific field in a specific index
-func CardinalityAggregate(index, doctype string, query map[string]interface{}, field string) (int64, error) {
+// CardinalityAggregate returns the unique count of a specific field
+func CardinalityAggregate(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, query interface{}, field string) (int64, error) {
 	request := map[string]interface{}{
 		"size": 0,
 		"aggs": map[string]interface{}{
@@ -93,13 +124,16 @@ func CardinalityAggregate(index, doctype string, query map[string]interface{}, f
 		request["query"] = query
 	}
 
-	// call search
-
 	result := struct {
 		Aggregations map[string]struct {
 			Value int64 `json:"value"`
 		} `json:"aggregations"`
 	}{}
+
+	if err := execSearch(ctx, esc, log, request, &result); err != nil {
+		return 0, err
+	}
+
 	value, ok := result.Aggregations["count_"+field]
 	if !ok {
 		return 0, errors.New("could not find count of field")
@@ -109,8 +143,26 @@ func CardinalityAggregate(index, doctype string, query map[string]interface{}, f
 
 var compositeSize = 500
 
-// @todo to utility
-func compositeAggregateAfter(query map[string]interface{}, field string, after interface{}) ([]*Bucket, error) {
+// max number of buckets in the aggregation result,
+// the same as search.max_buckets default in Elasticsearch
+const maxBuckets = 65536
+
+var errTooManyBuckets = errors.New("aggregation would return too many buckets, use a larger interval")
+
+// document fields other than record values that can be aggregated over;
+// text fields are aggregated over their keyword subfields
+var aggregateMetaFields = map[string]string{
+	"resourceType":   "resourceType.keyword",
+	"namespace.name": "namespace.name.keyword",
+	"module.name":    "module.name.keyword",
+	"created.at":     "created.at",
+	"updated.at":     "updated.at",
+}
+
+// compositeAggregateAfter returns a page of buckets with all unique values of a field
+//
+// Returned after key can be used to fetch the next page; it is nil on the last page.
+func compositeAggregateAfter(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, query interface{}, field string, after interface{}) ([]*Bucket, map[string]interface{}, error) {
 	var compositeResult []*Bucket
 	request := map[string]interface{}{
 		"size": 0,
@@ -118,10 +170,12 @@ func compositeAggregateAfter(query map[string]interface{}, field string, after i
 			"my_buckets": map[string]interface{}{
 				"composite": map[string]interface{}{
 					"size": compositeSize,
-					"sources": map[string]interface{}{
-						field: map[string]interface{}{
-							"terms": map[string]interface{}{
-								"field": field,
+					"sources": []interface{}{
+						map[string]interface{}{
+							field: map[string]interface{}{
+								"terms": map[string]interface{}{
+									"field": field,
+								},
 							},
 						},
 					},
@@ -136,12 +190,11 @@ func compositeAggregateAfter(query map[string]interface{}, field string, after i
 		request["query"] = query
 	}
 
-	// call search
-
-	_ = struct {
+	result := struct {
 		Aggregations struct {
 			MyBuckets struct {
-				Buckets []*struct {
+				AfterKey map[string]interface{} `json:"after_key"`
+				Buckets  []*struct {
 					Key   map[string]interface{} `json:"key"`
 					Count int                    `json:"doc_count"`
 				} `json:"buckets"`
@@ -149,7 +202,20 @@ func compositeAggregateAfter(query map[string]interface{}, field string, after i
 		} `json:"aggregations"`
 	}{}
 
-	return compositeResult, nil
+	if err := execSearch(ctx, esc, log, request, &result); err != nil {
+		return nil, nil, err
+	}
+
+	for _, bucket := range result.Aggregations.MyBuckets.Buckets {
+		compositeResult = append(compositeResult, &Bucket{Key: bucket.Key[field], Count: bucket.Count})
+	}
+
+	if len(compositeResult) < compositeSize {
+		// last page
+		return compositeResult, nil, nil
+	}
+
+	return compositeResult, result.Aggregations.MyBuckets.AfterKey, nil
 }
 
 type DateHistogramInterval string
@@ -164,8 +230,8 @@ const (
 	DateHistogramIntervalAuto   = "auto"
 )
 
-// DateHistogramAggregate fixme to utility
-func DateHistogramAggregate(query map[string]interface{}, field string, interval DateHistogramInterval, buckets int) ([]*Bucket, error) {
+// DateHistogramAggregate returns number of documents per interval
+func DateHistogramAggregate(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, query interface{}, field string, interval DateHistogramInterval, buckets int) ([]*Bucket, error) {
 	var dateHistogramResult []*Bucket
 	var request map[string]interface{}
 	if interval == DateHistogramIntervalAuto {
@@ -186,8 +252,8 @@ func DateHistogramAggregate(query map[string]interface{}, field string, interval
 			"aggs": map[string]interface{}{
 				"my_datehistogram": map[string]interface{}{
 					"date_histogram": map[string]interface{}{
-						"field":    field,
-						"interval": string(interval),
+						"field":             field,
+						"calendar_interval": string(interval),
 					},
 				},
 			},
@@ -197,7 +263,6 @@ func DateHistogramAggregate(query map[string]interface{}, field string, interval
 		request["query"] = query
 	}
 
-	// call search
 	result := struct {
 		Aggregations struct {
 			MyDateHistogram struct {
@@ -209,8 +274,161 @@ func DateHistogramAggregate(query map[string]interface{}, field string, interval
 		} `json:"aggregations"`
 	}{}
 
+	if err := execSearch(ctx, esc, log, request, &result); err != nil {
+		return nil, err
+	}
+
 	for _, bucket := range result.Aggregations.MyDateHistogram.DateHistogram {
 		dateHistogramResult = append(dateHistogramResult, &Bucket{Key: bucket.Key, Count: bucket.Count})
 	}
 	return dateHistogramResult, nil
 }
+
+// Aggregate runs one of the range, cardinality, composite or date histogram
+// aggregations over the documents matching the search
+func (h handlers) Aggregate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = r.ParseForm()
+
+	var (
+		ctx   = r.Context()
+		field = r.FormValue("field")
+	)
+
+	types, err := resourceTypes(r)
+	if err != nil {
+		writeError(w, errBadRequest(err))
+		return
+	}
+
+	p := aggregateParams{
+		kind:  r.FormValue("type"),
+		field: field,
+		search: searchParams{
+			tier:          accessTierFor(ctx, h.opt.ProtectedRoles),
+			query:         r.FormValue("q"),
+			moduleAggs:    r.Form["moduleAggs"],
+			namespaceAggs: r.Form["namespaceAggs"],
+			types:         types,
+			aggOnly:       true,
+		},
+	}
+
+	var aerr *apiError
+	if p.field, p.search.moduleIDs, aerr = h.aggregateField(ctx, p.search.tier, field); aerr != nil {
+		writeError(w, aerr)
+		return
+	}
+
+	switch p.kind {
+	case aggregateRange, aggregateCardinality:
+
+	case aggregateComposite:
+		if v := r.FormValue("after"); v != "" {
+			if p.after, err = decodeAfterKey(v); err != nil {
+				writeError(w, errBadRequest(err))
+				return
+			}
+		}
+
+	case aggregateDateHistogram:
+		p.interval = DateHistogramInterval(r.FormValue("interval"))
+		p.buckets = 10
+
+		switch p.interval {
+		case "":
+			p.interval = DateHistogramIntervalAuto
+		case DateHistogramIntervalYear, DateHistogramIntervalMonth, DateHistogramIntervalDay,
+			DateHistogramIntervalHour, DateHistogramIntervalMinute, DateHistogramIntervalSecond, DateHistogramIntervalAuto:
+		default:
+			writeError(w, errBadRequest(fmt.Errorf("invalid interval: %q", p.interval)))
+			return
+		}
+
+		if v := r.FormValue("buckets"); v != "" {
+			if p.buckets, err = strconv.Atoi(v); err != nil || p.buckets < 1 || p.buckets > maxBuckets {
+				writeError(w, errBadRequest(fmt.Errorf("invalid buckets: %q, must be between 1 and %d", v, maxBuckets)))
+				return
+			}
+		}
+
+	default:
+		writeError(w, errBadRequest(fmt.Errorf("invalid aggregation type: %q", p.kind)))
+		return
+	}
+
+	out, err := h.backend.Aggregate(ctx, p)
+	if tooManyBuckets(err) {
+		writeError(w, errBadRequest(errTooManyBuckets))
+		return
+	}
+
+	if err != nil {
+		h.log.Error("could not execute aggregation", zap.String("type", p.kind), zap.Error(err))
+		writeError(w, errBackend(err))
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(out); err != nil {
+		h.log.Error("could not encode response body", zap.Error(err))
+	}
+}
+
+// aggregateField checks if the user can aggregate over the field
+//
+// Returns the field to aggregate over; record values can be aggregated
+// only over the modules where the field is returned to the user,
+// IDs of those modules are returned as well.
+func (h handlers) aggregateField(ctx context.Context, tier accessTier, field string) (string, []string, *apiError) {
+	var (
+		base    = strings.TrimSuffix(field, ".keyword")
+		invalid = errBadRequest(fmt.Errorf("invalid field: %q", field))
+	)
+
+	if f, ok := aggregateMetaFields[base]; ok {
+		return f, nil, nil
+	}
+
+	if !strings.HasPrefix(base, valuesFieldPrefix) {
+		return "", nil, invalid
+	}
+
+	meta, err := h.meta.get()
+	if err != nil {
+		h.log.Error("failed to load metadata", zap.Error(err))
+		return "", nil, errCorteza(err)
+	}
+
+	_, roles := identity(ctx)
+	ids := meta.modulesWithField(tier, roles, strings.TrimPrefix(base, valuesFieldPrefix))
+	if len(ids) == 0 {
+		return "", nil, invalid
+	}
+
+	return field, ids, nil
+}
+
+// tooManyBuckets checks if aggregation failed because of the bucket limit
+func tooManyBuckets(err error) bool {
+	var serr *backendStatusError
+	return errors.Is(err, errTooManyBuckets) ||
+		errors.As(err, &serr) && (serr.Type == "too_many_buckets_exception" || serr.Cause == "too_many_buckets_exception")
+}
+
+func encodeAfterKey(after map[string]interface{}) string {
+	enc, _ := json.Marshal(after)
+	return base64.RawURLEncoding.EncodeToString(enc)
+}
+
+func decodeAfterKey(s string) (after map[string]interface{}, err error) {
+	dec, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid after key: %w", err)
+	}
+
+	if err = json.Unmarshal(dec, &after); err != nil {
+		return nil, fmt.Errorf("invalid after key")
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package searcher
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,125 +11,182 @@ import (
 )
 
 type (
-	credentials struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		expiresAt   time.Time
+	// ApiOptions configure access to the Corteza API
+	ApiOptions struct {
+		BaseURL string
+		AuthURL string
 
-		authBaseUri string
-		key         string
-		secret      string
+		// client credentials
+		ClientKey    string
+		ClientSecret string
+
+		// timeout of each request to the Corteza server
+		Timeout time.Duration
+
+		// how long before the expiry access token is refreshed
+		TokenRefreshMargin time.Duration
 	}
 
 	apiClient struct {
-		baseUri     string
-		credentials *credentials
+		opt    ApiOptions
+		client *http.Client
+		tokens *tokenSource
 	}
 )
 
-func httpClient() *http.Client {
-	return http.DefaultClient
-}
+func ApiClient(opt ApiOptions) (c *apiClient, err error) {
+	c = &apiClient{
+		opt: opt,
+		client: &http.Client{
+			Transport: &tracedTransport{base: http.DefaultTransport},
+			Timeout:   opt.Timeout,
+		},
+	}
+
+	c.tokens = &tokenSource{
+		client: c.client,
+		uri:    opt.AuthURL + "/oauth2/token",
+		key:    opt.ClientKey,
+		secret: opt.ClientSecret,
+		margin: opt.TokenRefreshMargin,
+	}
 
-func ApiClient(apiBaseUri, authBaseUri, key, secret string) (c *apiClient, err error) {
-	c = &apiClient{baseUri: apiBaseUri}
-	c.credentials = &credentials{authBaseUri: authBaseUri, key: key, secret: secret}
 	return c, err
 }
 
-func (c *apiClient) namespaces() (*http.Request, error) {
-	return c.request(fmt.Sprintf("%s/api/compose/namespace/", c.baseUri))
+func (c *apiClient) namespaces() string {
+	return fmt.Sprintf("%s/api/compose/namespace/", c.opt.BaseURL)
 }
 
-func (c *apiClient) modules(namespaceID uint64) (*http.Request, error) {
-	return c.request(fmt.Sprintf("%s/api/compose/namespace/%d/module/?sort=name+ASC", c.baseUri, namespaceID))
+func (c *apiClient) modules(namespaceID uint64) string {
+	return fmt.Sprintf("%s/api/compose/namespace/%d/module/?sort=name+ASC", c.opt.BaseURL, namespaceID)
 }
 
-func (c *apiClient) request(endpoint string) (req *http.Request, err error) {
-	if err = c.authenticate(); err != nil {
-		return
+// fetch sends authenticated request to the endpoint URI and decodes JSON response into dst
+//
+// Request rejected with 401 is retried once with a fresh token.
+// Endpoint names the request in metrics
+func (c *apiClient) fetch(ctx context.Context, endpoint, uri string, dst interface{}) (err error) {
+	defer func(start time.Time) { observeCorteza(endpoint, start, err) }(time.Now())
+
+	rsp, err := c.get(ctx, uri)
+	if err == nil && rsp.StatusCode == http.StatusUnauthorized {
+		rsp.Body.Close()
+		rsp, err = c.get(ctx, uri)
 	}
 
-	if req, err = http.NewRequest(http.MethodGet, endpoint, nil); err != nil {
-		err = fmt.Errorf("could not create request due to error: %w", err)
-		return
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request resulted in an unexpected status: %s", rsp.Status)
+	}
+
+	if err = json.NewDecoder(rsp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// get sends request with the current access token
+//
+// Token is invalidated when server rejects it
+func (c *apiClient) get(ctx context.Context, uri string) (*http.Response, error) {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request due to error: %w", err)
 	}
 
 	req.Header.Set("User-Agent", "corteza-discovery-indexer/0.1")
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.credentials.AccessToken))
-	return
-}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-func (c *apiClient) authenticate() (err error) {
-	if c.credentials == nil {
-		return fmt.Errorf("missing credentials")
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
-	if c.credentials.expiresAt.Before(time.Now()) {
-		c.credentials, err = authenticate(c.credentials.authBaseUri, c.credentials.key, c.credentials.secret)
-		if err != nil {
-			return
-		}
+	if rsp.StatusCode == http.StatusUnauthorized {
+		c.tokens.Invalidate(token)
 	}
 
-	return nil
+	return rsp, nil
 }
 
-func authenticate(authBaseUri, key, secret string) (crd *credentials, err error) {
+// introspect checks with the Corteza auth server if access token is still active
+//
+// Request is authenticated with the client credentials
+func (c *apiClient) introspect(ctx context.Context, token string) (active bool, err error) {
+	defer func(start time.Time) { observeCorteza("introspect", start, err) }(time.Now())
+
 	var (
 		req  *http.Request
 		rsp  *http.Response
 		form = url.Values{}
+		aux  = struct {
+			Active bool `json:"active"`
+		}{}
 	)
 
-	form.Set("grant_type", "client_credentials")
-	form.Set("scope", "profile api discovery")
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
 
-	req, err = http.NewRequest(http.MethodPost, authBaseUri+"/oauth2/token", strings.NewReader(form.Encode()))
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.opt.AuthURL+"/oauth2/introspect", strings.NewReader(form.Encode()))
 	if err != nil {
 		return
 	}
 
-	req.SetBasicAuth(key, secret)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	//d, _ := httputil.DumpRequest(req, true)
-	//println(string(d))
+	req.SetBasicAuth(c.opt.ClientKey, c.opt.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
 
-	rsp, err = httpClient().Do(req)
-	if err != nil {
-		return
+	if rsp, err = c.client.Do(req); err != nil {
+		return false, fmt.Errorf("failed to send request: %w", err)
 	}
 
 	defer rsp.Body.Close()
-	crd = &credentials{
-		authBaseUri: authBaseUri,
-		key:         key,
-		secret:      secret,
-	}
 
 	if rsp.StatusCode != http.StatusOK {
-		aux := struct{ Error string }{}
-		if err = json.NewDecoder(rsp.Body).Decode(&aux); err != nil {
-			return
-		} else if aux.Error != "" {
-			return nil, fmt.Errorf(aux.Error)
-		} else {
-			return nil, fmt.Errorf("can not authenticate, unexpected error")
-		}
+		return false, fmt.Errorf("introspection resulted in an unexpected status: %s", rsp.Status)
+	}
 
+	if err = json.NewDecoder(rsp.Body).Decode(&aux); err != nil {
+		return false, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	//d, _ := httputil.DumpResponse(rsp, true)
-	//println(string(d))
+	return aux.Active, nil
+}
 
-	err = json.NewDecoder(rsp.Body).Decode(crd)
+// ping checks if Corteza server responds
+//
+// Any response without server error status is considered fine
+func (c *apiClient) ping(ctx context.Context) (status int, err error) {
+	defer func(start time.Time) { observeCorteza("healthcheck", start, err) }(time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.opt.BaseURL+"/healthcheck", nil)
 	if err != nil {
 		return
 	}
 
-	crd.expiresAt = time.Now().Add(time.Second * time.Duration(crd.ExpiresIn))
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		return rsp.StatusCode, fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
 
-	return
+	return rsp.StatusCode, nil
 }
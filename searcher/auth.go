@@ -0,0 +1,52 @@
+package searcher
+
+import (
+	"errors"
+	"github.com/go-chi/jwtauth"
+	"net/http"
+)
+
+// authenticator rejects requests without a valid access token
+//
+// Tokens are verified (and stored in the context) by the verifier and
+// introspection middlewares; expects jwtauth.ErrExpired for expired
+// and errTokenRevoked for revoked tokens.
+func authenticator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, err := jwtauth.FromContext(r.Context())
+
+		switch {
+		case errors.Is(err, jwtauth.ErrNoTokenFound):
+			writeAuthError(w, errUnauthorized("token_missing", "access token is required"))
+
+		case errors.Is(err, jwtauth.ErrExpired):
+			writeAuthError(w, errUnauthorized("token_expired", "access token has expired"))
+
+		case errors.Is(err, errTokenRevoked):
+			writeAuthError(w, errUnauthorized("token_revoked", "access token has been revoked"))
+
+		case err != nil || token == nil || !token.Valid:
+			writeAuthError(w, errUnauthorized("token_invalid", "access token is invalid"))
+
+		default:
+			if userID, _ := identity(r.Context()); userID == 0 {
+				// valid token but not issued to a user
+				writeAuthError(w, errForbidden("user_required", "access token is not issued to a user"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func writeAuthError(w http.ResponseWriter, e *apiError) {
+	switch {
+	case e.Code == "token_missing":
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	case e.status == http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+
+	writeError(w, e)
+}
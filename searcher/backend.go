@@ -0,0 +1,67 @@
+package searcher
+
+import (
+	"context"
+)
+
+type (
+	// Backend executes searches over indexed Corteza resources
+	//
+	// All methods apply the same access rules (index tier and role filters)
+	// based on the params and the identity in the context.
+	Backend interface {
+		// Search executes all queries in a single round-trip
+		//
+		// Responses are returned in the same order as params;
+		// failed query results in a nil response.
+		Search(ctx context.Context, pp ...searchParams) ([]*esSearchResponse, error)
+
+		// Suggest returns hits for search-as-you-type completions
+		Suggest(ctx context.Context, p suggestParams) (*esSearchResponse, error)
+
+		// Aggregate runs range, cardinality, composite or date histogram aggregation
+		Aggregate(ctx context.Context, p aggregateParams) (*cdAggregateResult, error)
+
+		// Get returns a single document by ID or nil when document does not exist
+		Get(ctx context.Context, tier accessTier, id string) (*esSearchHit, error)
+
+		// Ping checks if backend is available
+		Ping(ctx context.Context) error
+
+		// Health returns cluster status and number of indexes per access tier
+		Health(ctx context.Context) (*backendHealth, error)
+
+		// Engine returns name and version of the search engine
+		Engine() (name, version string)
+	}
+
+	backendHealth struct {
+		// green, yellow or red
+		Status string `json:"status"`
+
+		// index prefix => number of indexes
+		Indexes map[string]int `json:"indexes"`
+	}
+
+	aggregateParams struct {
+		kind  string
+		field string
+
+		// date histogram
+		interval DateHistogramInterval
+		buckets  int
+
+		// composite, key of the last bucket from the previous page
+		after map[string]interface{}
+
+		// documents to aggregate over
+		search searchParams
+	}
+)
+
+const (
+	aggregateRange         = "range"
+	aggregateCardinality   = "cardinality"
+	aggregateComposite     = "composite"
+	aggregateDateHistogram = "dateHistogram"
+)
@@ -20,12 +20,22 @@ type (
 		TotalHits    int             `json:"total_hits"`
 		Aggregations []cdAggregation `json:"aggregations"`
 
+		// Cursors for fetching next and previous page of hits
+		Next string `json:"next,omitempty"`
+		Prev string `json:"prev,omitempty"`
+
+		// Facets, labels... that could not be resolved
+		Warnings []cdWarning `json:"warnings"`
+
 		// Context ldCtx `json:"@context"`
 	}
 
 	cdHit struct {
 		Type  string      `json:"type"`
 		Value interface{} `json:"value"`
+
+		// Matched text in context, indexed by field
+		Highlight map[string][]string `json:"highlight,omitempty"`
 	}
 
 	cdAggregation struct {
@@ -52,7 +62,11 @@ type (
 )
 
 // conv converts results from the backend into corteza-discovery (jsonld-ish) format
-func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits bool, moduleMeta map[string][]string, nsHandleMap map[string]string, mHandleMap map[string]string) (out *cdResults, err error) {
+//
+// Only record values of the fields listed in moduleMeta are returned;
+// records of modules not in moduleMeta are returned without values or
+// omitted when omitUnconfigured is set.
+func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits, omitUnconfigured bool, moduleMeta map[string][]string, nsHandleMap map[string]string, mHandleMap map[string]string) (out *cdResults, err error) {
 	if sr == nil {
 		return
 	}
@@ -201,6 +215,58 @@ func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits bool, modu
 		out.Aggregations = append(out.Aggregations, mAggregation)
 	}
 
+	rAggregation := cdAggregation{
+		Name:         "Resource",
+		Resource:     "resourceType",
+		Hits:         0,
+		ResourceName: []cdAggregationHits{},
+	}
+
+	for _, bucket := range aggsRes.Resource.Buckets {
+		rAggregation.Hits += bucket.DocCount
+		rAggregation.ResourceName = append(rAggregation.ResourceName, cdAggregationHits{
+			Name:  bucket.Key,
+			Label: getResourceName(bucket.Key),
+			Hits:  bucket.DocCount,
+		})
+	}
+
+	if len(rAggregation.ResourceName) > 0 {
+		sort.Slice(rAggregation.ResourceName, func(i, j int) bool {
+			return rAggregation.ResourceName[i].Name < rAggregation.ResourceName[j].Name
+		})
+		out.Aggregations = append(out.Aggregations, rAggregation)
+	}
+
+	// Module field facets
+	facets := make([]string, 0, len(aggsRes.Facets))
+	for f := range aggsRes.Facets {
+		facets = append(facets, f)
+	}
+	sort.Strings(facets)
+
+	for _, f := range facets {
+		fAggregation := cdAggregation{
+			Name:         f,
+			Resource:     "field",
+			Hits:         0,
+			ResourceName: []cdAggregationHits{},
+		}
+
+		for _, bucket := range aggsRes.Facets[f].Buckets {
+			fAggregation.Hits += bucket.Count
+			fAggregation.ResourceName = append(fAggregation.ResourceName, cdAggregationHits{
+				Name:  cast.ToString(bucket.Key),
+				Label: cast.ToString(bucket.Key),
+				Hits:  bucket.Count,
+			})
+		}
+
+		if len(fAggregation.ResourceName) > 0 {
+			out.Aggregations = append(out.Aggregations, fAggregation)
+		}
+	}
+
 	if !noHits {
 	hits:
 		for _, h := range sr.Hits.Hits {
@@ -211,6 +277,9 @@ func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits bool, modu
 
 			resType := cast.ToString(aux["resourceType"])
 			delete(aux, "resourceType")
+
+			// access control internals
+			delete(aux, "security")
 			switch resType {
 			case "system:user":
 				aux["id"] = aux["userID"]
@@ -257,45 +326,34 @@ func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits bool, modu
 				}
 				key := fmt.Sprintf("%d-%d", r.Namespace.NamespaceId, r.Module.ModuleId)
 				var (
-					slice []valueJson
+					slice = make([]valueJson, 0, len(moduleMeta[key]))
 					uc    = created{
 						At: r.Created.At,
 						By: getCreatedBy(r.Created.By),
 					}
 				)
 
-				if val, is := moduleMeta[key]; is {
-					for _, f := range val {
-						slice = append(slice, valueJson{
-							Name:  f,
-							Label: r.ValueLabels[f],
-							Value: r.Values[f],
-						})
-
-						if vv, ok := r.Values[f].([]interface{}); ok {
-							if len(vv) > 0 {
-								ssVal[f] = vv[0]
-							}
-						}
-					}
-				} else {
-					for k, v := range r.Values {
-						// @todo hardcoded value
-						if len(slice) < 5 {
-							slice = append(slice, valueJson{
-								Name:  k,
-								Label: r.ValueLabels[k],
-								Value: v,
-							})
-
-							if vv, ok := v.([]interface{}); ok {
-								if len(vv) > 0 {
-									ssVal[k] = vv[0]
-								}
-							}
+				val, is := moduleMeta[key]
+				if !is && omitUnconfigured {
+					continue hits
+				}
+
+				for _, f := range val {
+					slice = append(slice, valueJson{
+						Name:  f,
+						Label: r.ValueLabels[f],
+						Value: r.Values[f],
+					})
+
+					if vv, ok := r.Values[f].([]interface{}); ok {
+						if len(vv) > 0 {
+							ssVal[f] = vv[0]
 						}
 					}
 				}
+
+				// highlight must not reveal values of fields that are not returned
+				h.Highlight = allowedHighlight(h.Highlight, val)
 				aux["created"] = uc
 				aux["customValues"] = ssVal
 				aux["values"] = slice
@@ -319,8 +377,9 @@ func conv(sr *esSearchResponse, aggregation *esSearchResponse, noHits bool, modu
 			}
 
 			out.Hits = append(out.Hits, cdHit{
-				Type:  resType,
-				Value: aux,
+				Type:      resType,
+				Value:     aux,
+				Highlight: convHighlight(h.Highlight),
 			})
 		}
 		out.TotalHits = len(out.Hits)
@@ -0,0 +1,822 @@
+package searcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	"html"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type (
+	// embeddedBackend keeps all documents in memory
+	//
+	// It is meant for small installations without an Elasticsearch
+	// cluster and for running handlers without external services;
+	// queries are evaluated with the same semantics as searchQuery
+	// builds them for Elasticsearch (prefix matching, no stemming).
+	embeddedBackend struct {
+		log  *zap.Logger
+		docs []*embeddedDoc
+		byID map[string]*embeddedDoc
+
+		// field with document ID, hits sort tiebreaker
+		tiebreaker string
+	}
+
+	embeddedDoc struct {
+		Index  string          `json:"_index"`
+		ID     string          `json:"_id"`
+		Source json.RawMessage `json:"_source"`
+
+		// decoded source
+		doc map[string]interface{}
+
+		// lower-cased words from all (non-security) string values
+		words []string
+	}
+
+	embeddedMatch struct {
+		doc   *embeddedDoc
+		score float64
+
+		// value of the tiebreaker field
+		key string
+	}
+)
+
+// EmbeddedBackend loads documents from a file and returns in-memory Backend
+//
+// File can contain a JSON array or a stream of JSON objects (one per line),
+// each in the same format as Elasticsearch hits: {"_index", "_id", "_source"}
+//
+// Hits with the same score are ordered by the tiebreaker field
+// ("_id" or a field from the source), the same as with Elasticsearch
+func EmbeddedBackend(log *zap.Logger, path, tiebreaker string) (*embeddedBackend, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read documents: %w", err)
+	}
+
+	b := &embeddedBackend{
+		log:        log.Named("embedded"),
+		byID:       make(map[string]*embeddedDoc),
+		tiebreaker: tiebreaker,
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var dd []*embeddedDoc
+		if err = json.Unmarshal(raw, &dd); err != nil {
+			return nil, fmt.Errorf("could not decode documents: %w", err)
+		}
+
+		for _, d := range dd {
+			if err = b.add(d); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		for {
+			d := &embeddedDoc{}
+			if err = dec.Decode(d); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("could not decode documents: %w", err)
+			}
+
+			if err = b.add(d); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b.log.Info("documents loaded", zap.String("path", path), zap.Int("count", len(b.docs)))
+
+	return b, nil
+}
+
+func (b *embeddedBackend) add(d *embeddedDoc) error {
+	if d.Index == "" || d.ID == "" {
+		return fmt.Errorf("document without _index or _id")
+	}
+
+	if err := json.Unmarshal(d.Source, &d.doc); err != nil {
+		return fmt.Errorf("could not decode source of document %s: %w", d.ID, err)
+	}
+
+	for k, v := range d.doc {
+		if k != "security" {
+			d.words = append(d.words, words(v)...)
+		}
+	}
+
+	if _, has := b.byID[d.ID]; !has {
+		b.docs = append(b.docs, d)
+	}
+
+	b.byID[d.ID] = d
+	return nil
+}
+
+func (b *embeddedBackend) Search(ctx context.Context, pp ...searchParams) ([]*esSearchResponse, error) {
+	out := make([]*esSearchResponse, len(pp))
+	for i, p := range pp {
+		sr, err := b.search(ctx, p)
+		if err != nil {
+			b.log.Error("search failed", zap.Int("query", i), zap.Error(err))
+			continue
+		}
+
+		out[i] = sr
+	}
+
+	return out, nil
+}
+
+func (b *embeddedBackend) search(ctx context.Context, p searchParams) (sr *esSearchResponse, err error) {
+	var (
+		mm      = b.matching(ctx, p)
+		reverse = p.paging.cursor != nil && p.paging.cursor.Reverse
+		aggs    = make(map[string]interface{})
+	)
+
+	sr = &esSearchResponse{}
+	sr.Hits.Total.Value = len(mm)
+	sr.Hits.Total.Relation = "eq"
+
+	// Aggregations
+	if p.rAggOnly {
+		aggs["resource"] = termsAgg(mm, "resourceType", 0)
+	} else {
+		aggs["namespace"] = termsAgg(mm, "namespace.name", 0)
+
+		if len(p.query) > 0 || len(p.namespaceAggs) > 0 {
+			aggs["module"] = termsAgg(mm, "module.name", 0)
+		}
+	}
+
+	if !p.aggOnly {
+		for _, f := range p.facets {
+			// same as terms aggregation default size
+			aggs[valuesFieldPrefix+f] = termsAgg(mm, valuesFieldPrefix+f, 10)
+		}
+	}
+
+	if enc, err := json.Marshal(aggs); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(enc, &sr.Aggregations); err != nil {
+		return nil, err
+	}
+
+	if p.aggOnly {
+		return
+	}
+
+	// Hits
+	for _, m := range mm {
+		if m.key, err = m.doc.sortKey(b.tiebreaker); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(mm, func(i, j int) bool {
+		return mm[i].before(mm[j], reverse)
+	})
+
+	if p.paging.cursor != nil {
+		var (
+			score float64
+			id    string
+			after = p.paging.cursor.After
+		)
+
+		if len(after) != 2 || json.Unmarshal(after[0], &score) != nil || json.Unmarshal(after[1], &id) != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+
+		pivot := embeddedMatch{score: score, key: id}
+		for len(mm) > 0 && !pivot.before(mm[0], reverse) {
+			mm = mm[1:]
+		}
+	} else if from := p.paging.from(); from < len(mm) {
+		mm = mm[from:]
+	} else {
+		mm = nil
+	}
+
+	// fetch one more to detect next page, the same as with Elasticsearch
+	if size := p.paging.perPage + 1; len(mm) > size {
+		mm = mm[:size]
+	}
+
+	for _, m := range mm {
+		h := &esSearchHit{Index: m.doc.Index, ID: m.doc.ID, Source: m.doc.Source}
+		score, _ := json.Marshal(m.score)
+		id, _ := json.Marshal(m.key)
+		h.Sort = []json.RawMessage{score, id}
+		h.Highlight = highlightDoc(m.doc, p.query, p.highlight)
+
+		sr.Hits.Hits = append(sr.Hits.Hits, h)
+	}
+
+	sr.paginate(p.paging, p.aggOnly)
+	return
+}
+
+// matching returns all visible documents that match the search params
+func (b *embeddedBackend) matching(ctx context.Context, p searchParams) (mm []*embeddedMatch) {
+	var (
+		terms = words(p.query)
+	)
+
+	for _, d := range b.docs {
+		if !d.visible(ctx, p.tier) {
+			continue
+		}
+
+		if len(p.types) > 0 && !d.in("resourceType", p.types) {
+			continue
+		}
+
+		if len(p.moduleIDs) > 0 && !d.in("module.moduleId", p.moduleIDs) {
+			continue
+		}
+
+		if !p.aggOnly && len(p.namespaceAggs) > 0 && !d.in("namespace.name", p.namespaceAggs) {
+			continue
+		}
+
+		// Modules (and namespaces for aggregations) are OR-ed (dis_max)
+		if len(p.moduleAggs) > 0 || (p.aggOnly && len(p.namespaceAggs) > 0) {
+			if !d.in("module.name", p.moduleAggs) && !(p.aggOnly && d.in("namespace.name", p.namespaceAggs)) {
+				continue
+			}
+		}
+
+		filtered := false
+		for f, vv := range p.filters {
+			if !d.in(valuesFieldPrefix+f, vv) {
+				filtered = true
+				break
+			}
+		}
+
+		if filtered {
+			continue
+		}
+
+		m := &embeddedMatch{doc: d, score: 1}
+		if len(terms) > 0 {
+			// Terms are OR-ed, score is the number of matched terms
+			m.score = 0
+			for _, t := range terms {
+				for _, w := range d.words {
+					if strings.HasPrefix(w, t) {
+						m.score++
+						break
+					}
+				}
+			}
+
+			if m.score == 0 {
+				continue
+			}
+		}
+
+		mm = append(mm, m)
+	}
+
+	return
+}
+
+func (b *embeddedBackend) Suggest(ctx context.Context, p suggestParams) (*esSearchResponse, error) {
+	var (
+		q  = strings.ToLower(p.query)
+		mm []*embeddedMatch
+		sr = &esSearchResponse{}
+	)
+
+	for _, d := range b.docs {
+		if !d.visible(ctx, p.tier) {
+			continue
+		}
+
+		m := &embeddedMatch{doc: d, key: d.ID}
+		for field, boost := range map[string]float64{"name": 3, "handle": 2} {
+			if phrasePrefix(d.strings(field), q) {
+				m.score += boost
+			}
+		}
+
+		// only fields visible to the user, the same as suggestQuery
+		key := fmt.Sprintf("%s-%s", d.first("namespace.namespaceId"), d.first("module.moduleId"))
+		for _, f := range p.fields[key] {
+			if phrasePrefix(d.strings(valuesFieldPrefix+f), q) {
+				m.score++
+				break
+			}
+		}
+
+		if m.score > 0 {
+			mm = append(mm, m)
+		}
+	}
+
+	sort.SliceStable(mm, func(i, j int) bool {
+		return mm[i].before(mm[j], false)
+	})
+
+	sr.Hits.Total.Value = len(mm)
+	sr.Hits.Total.Relation = "eq"
+	for i, m := range mm {
+		if i >= p.limit {
+			break
+		}
+
+		sr.Hits.Hits = append(sr.Hits.Hits, &esSearchHit{Index: m.doc.Index, ID: m.doc.ID, Source: m.doc.Source})
+	}
+
+	return sr, nil
+}
+
+func (b *embeddedBackend) Aggregate(ctx context.Context, p aggregateParams) (out *cdAggregateResult, err error) {
+	var (
+		mm    = b.matching(ctx, p.search)
+		field = strings.TrimSuffix(p.field, ".keyword")
+	)
+
+	out = &cdAggregateResult{Type: p.kind, Field: p.field}
+
+	switch p.kind {
+	case aggregateRange:
+		// without values min and max are omitted, the same as with Elasticsearch
+		for _, v := range numbers(mm, field) {
+			if out.Min == nil || v < *out.Min {
+				min := v
+				out.Min = &min
+			}
+			if out.Max == nil || v > *out.Max {
+				max := v
+				out.Max = &max
+			}
+		}
+
+	case aggregateCardinality:
+		count := int64(len(termsCount(mm, field)))
+		out.Count = &count
+
+	case aggregateComposite:
+		var (
+			counts = termsCount(mm, field)
+			keys   = make([]string, 0, len(counts))
+			after  = ""
+		)
+
+		if p.after != nil {
+			after = cast.ToString(p.after[p.field])
+		}
+
+		for k := range counts {
+			if after == "" || k > after {
+				keys = append(keys, k)
+			}
+		}
+
+		sort.Strings(keys)
+		if len(keys) > compositeSize {
+			keys = keys[:compositeSize]
+		}
+
+		for _, k := range keys {
+			out.Buckets = append(out.Buckets, &Bucket{Key: k, Count: counts[k]})
+		}
+
+		if len(keys) == compositeSize {
+			out.After = encodeAfterKey(map[string]interface{}{p.field: keys[len(keys)-1]})
+		}
+
+	case aggregateDateHistogram:
+		if out.Buckets, err = dateHistogram(dates(mm, field), p.interval, p.buckets); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown aggregation type: %q", p.kind)
+	}
+
+	return out, nil
+}
+
+func (b *embeddedBackend) Get(ctx context.Context, tier accessTier, id string) (*esSearchHit, error) {
+	d, has := b.byID[id]
+	if !has || !d.visible(ctx, tier) {
+		return nil, nil
+	}
+
+	return &esSearchHit{Index: d.Index, ID: d.ID, Source: d.Source}, nil
+}
+
+func (b *embeddedBackend) Ping(context.Context) error {
+	return nil
+}
+
+// Health counts indexes the documents were loaded from; status is always green
+func (b *embeddedBackend) Health(context.Context) (*backendHealth, error) {
+	var (
+		h    = &backendHealth{Status: "green", Indexes: tierIndexes()}
+		seen = make(map[string]bool)
+	)
+
+	for _, d := range b.docs {
+		if seen[d.Index] {
+			continue
+		}
+
+		seen[d.Index] = true
+		h.count(d.Index)
+	}
+
+	return h, nil
+}
+
+func (b *embeddedBackend) Engine() (string, string) {
+	return "embedded", ""
+}
+
+// visible checks index tier and role filters, the same as baseQuery
+func (d *embeddedDoc) visible(ctx context.Context, tier accessTier) bool {
+	if !strings.HasPrefix(d.Index, tier.indexPrefix()) {
+		return false
+	}
+
+	if tier == tierPublic {
+		return true
+	}
+
+	_, roles := identity(ctx)
+	return d.in("security.allowedRoles", roles) && !d.in("security.deniedRoles", roles)
+}
+
+// in checks if any of the field values is one of the given values
+func (d *embeddedDoc) in(field string, values []string) bool {
+	for _, v := range d.strings(field) {
+		for _, c := range values {
+			if v == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// strings returns all values of the field (dotted path) as strings
+func (d *embeddedDoc) strings(field string) (out []string) {
+	for _, v := range fieldValues(d.doc, strings.TrimSuffix(field, ".keyword")) {
+		out = append(out, cast.ToString(v))
+	}
+
+	return
+}
+
+// sortKey returns value of the tiebreaker field
+//
+// Unlike Elasticsearch (that sorts documents without the value last),
+// documents without it are rejected so misconfigured tiebreaker is noticed
+func (d *embeddedDoc) sortKey(tiebreaker string) (string, error) {
+	if tiebreaker == "_id" {
+		return d.ID, nil
+	}
+
+	if vv := d.strings(tiebreaker); len(vv) > 0 {
+		return vv[0], nil
+	}
+
+	return "", fmt.Errorf("document %s has no value in the sort tiebreaker field %s", d.ID, tiebreaker)
+}
+
+// first returns the first value of the field
+func (d *embeddedDoc) first(field string) string {
+	if vv := d.strings(field); len(vv) > 0 {
+		return vv[0]
+	}
+
+	return ""
+}
+
+// before determines order of the hits: by score and then by the tiebreaker
+func (m embeddedMatch) before(o *embeddedMatch, reverse bool) bool {
+	if m.score != o.score {
+		return (m.score > o.score) != reverse
+	}
+
+	if m.key == o.key {
+		return false
+	}
+
+	return (m.key < o.key) != reverse
+}
+
+// fieldValues returns flattened values under the dotted path
+func fieldValues(v interface{}, path string) (out []interface{}) {
+	switch vv := v.(type) {
+	case []interface{}:
+		for _, i := range vv {
+			out = append(out, fieldValues(i, path)...)
+		}
+
+	case map[string]interface{}:
+		if path == "" {
+			return nil
+		}
+
+		key, rest := path, ""
+		if i := strings.Index(path, "."); i > -1 {
+			key, rest = path[:i], path[i+1:]
+		}
+
+		return fieldValues(vv[key], rest)
+
+	case nil:
+
+	default:
+		if path == "" {
+			out = append(out, vv)
+		}
+	}
+
+	return
+}
+
+// words returns lower-cased words from all string values
+func words(v interface{}) (out []string) {
+	switch vv := v.(type) {
+	case string:
+		return strings.FieldsFunc(strings.ToLower(vv), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+	case []interface{}:
+		for _, i := range vv {
+			out = append(out, words(i)...)
+		}
+
+	case map[string]interface{}:
+		for _, i := range vv {
+			out = append(out, words(i)...)
+		}
+	}
+
+	return
+}
+
+// phrasePrefix checks if any of the values has a word sequence starting with q
+func phrasePrefix(values []string, q string) bool {
+	for _, v := range values {
+		v = strings.ToLower(v)
+		if strings.HasPrefix(v, q) || strings.Contains(v, " "+q) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// highlightDoc wraps words matching the query terms in the highlighted fields
+func highlightDoc(d *embeddedDoc, query string, hl *esHighlight) (out map[string][]string) {
+	terms := words(query)
+	if hl == nil || len(terms) == 0 {
+		return nil
+	}
+
+	for field := range hl.Fields {
+		for _, v := range d.strings(field) {
+			if fragment, matched := highlightValue(v, terms, hl.PreTags[0], hl.PostTags[0]); matched {
+				if out == nil {
+					out = make(map[string][]string)
+				}
+
+				out[field] = append(out[field], fragment)
+			}
+		}
+	}
+
+	return
+}
+
+// highlightValue wraps words matching any of the terms with the tags
+//
+// Text is HTML escaped, the same as with the html encoder in Elasticsearch
+func highlightValue(v string, terms []string, pre, post string) (string, bool) {
+	var (
+		b       strings.Builder
+		matched bool
+	)
+
+	for len(v) > 0 {
+		// whitespace is copied as it is
+		if i := strings.IndexFunc(v, func(r rune) bool { return !unicode.IsSpace(r) }); i != 0 {
+			if i < 0 {
+				i = len(v)
+			}
+
+			b.WriteString(v[:i])
+			v = v[i:]
+			continue
+		}
+
+		i := strings.IndexFunc(v, unicode.IsSpace)
+		if i < 0 {
+			i = len(v)
+		}
+
+		w := v[:i]
+		v = v[i:]
+
+		if hasAnyPrefix(strings.ToLower(w), terms) {
+			b.WriteString(pre + html.EscapeString(w) + post)
+			matched = true
+		} else {
+			b.WriteString(html.EscapeString(w))
+		}
+	}
+
+	return b.String(), matched
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// termsCount counts documents per value of the field
+func termsCount(mm []*embeddedMatch, field string) map[string]int {
+	counts := make(map[string]int)
+	for _, m := range mm {
+		seen := make(map[string]bool)
+		for _, v := range m.doc.strings(field) {
+			if !seen[v] {
+				seen[v] = true
+				counts[v]++
+			}
+		}
+	}
+
+	return counts
+}
+
+// termsAgg returns terms aggregation result, ordered by count (desc) and key
+func termsAgg(mm []*embeddedMatch, field string, size int) EsSearchAggrResult {
+	var (
+		counts = termsCount(mm, field)
+		res    = EsSearchAggrResult{Buckets: []Bucket{}}
+	)
+
+	for k, c := range counts {
+		res.Buckets = append(res.Buckets, Bucket{Key: k, Count: c})
+	}
+
+	sort.Slice(res.Buckets, func(i, j int) bool {
+		if res.Buckets[i].Count != res.Buckets[j].Count {
+			return res.Buckets[i].Count > res.Buckets[j].Count
+		}
+
+		return cast.ToString(res.Buckets[i].Key) < cast.ToString(res.Buckets[j].Key)
+	})
+
+	if size > 0 && len(res.Buckets) > size {
+		res.Buckets = res.Buckets[:size]
+	}
+
+	return res
+}
+
+func numbers(mm []*embeddedMatch, field string) (out []float64) {
+	for _, m := range mm {
+		for _, v := range fieldValues(m.doc.doc, field) {
+			if n, err := cast.ToFloat64E(v); err == nil {
+				out = append(out, n)
+			}
+		}
+	}
+
+	return
+}
+
+func dates(mm []*embeddedMatch, field string) (out []time.Time) {
+	for _, m := range mm {
+		for _, v := range fieldValues(m.doc.doc, field) {
+			if t, err := cast.ToTimeE(v); err == nil {
+				out = append(out, t.UTC())
+			}
+		}
+	}
+
+	return
+}
+
+// dateHistogram counts dates per interval, including empty intervals in between
+//
+// With auto interval, the smallest interval that fits into the number of buckets is used;
+// explicit interval that results in more than maxBuckets buckets is rejected.
+func dateHistogram(tt []time.Time, interval DateHistogramInterval, buckets int) (out []*Bucket, err error) {
+	if len(tt) == 0 {
+		return
+	}
+
+	sort.Slice(tt, func(i, j int) bool { return tt[i].Before(tt[j]) })
+
+	if interval == DateHistogramIntervalAuto {
+		for _, interval = range []DateHistogramInterval{
+			DateHistogramIntervalSecond,
+			DateHistogramIntervalMinute,
+			DateHistogramIntervalHour,
+			DateHistogramIntervalDay,
+			DateHistogramIntervalMonth,
+			DateHistogramIntervalYear,
+		} {
+			if intervalCount(tt[0], tt[len(tt)-1], interval) <= buckets {
+				break
+			}
+		}
+	}
+
+	if intervalCount(tt[0], tt[len(tt)-1], interval) > maxBuckets {
+		return nil, errTooManyBuckets
+	}
+
+	var (
+		counts = make(map[time.Time]int)
+		last   = truncate(tt[len(tt)-1], interval)
+	)
+
+	for _, t := range tt {
+		counts[truncate(t, interval)]++
+	}
+
+	for t := truncate(tt[0], interval); !t.After(last); t = next(t, interval) {
+		out = append(out, &Bucket{Key: t.UnixNano() / int64(time.Millisecond), Count: counts[t]})
+	}
+
+	return
+}
+
+// intervalCount counts intervals between the dates, up to maxBuckets+1
+func intervalCount(from, to time.Time, interval DateHistogramInterval) (n int) {
+	for t := truncate(from, interval); !t.After(to); t = next(t, interval) {
+		if n++; n > maxBuckets {
+			break
+		}
+	}
+
+	return
+}
+
+func truncate(t time.Time, interval DateHistogramInterval) time.Time {
+	switch interval {
+	case DateHistogramIntervalYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	case DateHistogramIntervalMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case DateHistogramIntervalDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case DateHistogramIntervalHour:
+		return t.Truncate(time.Hour)
+	case DateHistogramIntervalMinute:
+		return t.Truncate(time.Minute)
+	default:
+		return t.Truncate(time.Second)
+	}
+}
+
+func next(t time.Time, interval DateHistogramInterval) time.Time {
+	switch interval {
+	case DateHistogramIntervalYear:
+		return t.AddDate(1, 0, 0)
+	case DateHistogramIntervalMonth:
+		return t.AddDate(0, 1, 0)
+	case DateHistogramIntervalDay:
+		return t.AddDate(0, 0, 1)
+	case DateHistogramIntervalHour:
+		return t.Add(time.Hour)
+	case DateHistogramIntervalMinute:
+		return t.Add(time.Minute)
+	default:
+		return t.Add(time.Second)
+	}
+}
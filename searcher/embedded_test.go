@@ -0,0 +1,44 @@
+package searcher
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docs.ndjson")
+	if err := ioutil.WriteFile(path, []byte(testDocs), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := EmbeddedBackend(zap.NewNop(), path, "_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		id    string
+		found bool
+	}{
+		{"public", "p1", true},
+		{"private", "r1", false},
+		{"missing", "x1", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hit, err := b.Get(context.Background(), tierPublic, c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (hit != nil) != c.found {
+				t.Errorf("expected found=%v, got %v", c.found, hit)
+			}
+		})
+	}
+}
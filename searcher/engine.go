@@ -0,0 +1,103 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+type (
+	// esEngine holds search engine detected behind the Elasticsearch API
+	esEngine struct {
+		name    string
+		version string
+	}
+)
+
+const (
+	EngineAuto          = "auto"
+	EngineElasticsearch = "elasticsearch"
+	EngineOpenSearch    = "opensearch"
+)
+
+// Detect resolves engine (Elasticsearch or OpenSearch) and its version
+//
+// Elasticsearch 7.14+ is expected to identify itself with the
+// X-Elastic-Product header; OpenSearch does not send it and reports
+// its own version (or 7.10.2 in compatibility mode), so the product check
+// is skipped for it. Detection is retried on ping when it fails at startup.
+func (b *esBackend) Detect(ctx context.Context) error {
+	res, err := b.esc.Info(b.esc.Info.WithContext(ctx))
+	if err = validElasticResponse(b.log, res, err); err != nil {
+		return fmt.Errorf("could not detect search engine: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	var info struct {
+		Tagline string `json:"tagline"`
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return fmt.Errorf("could not decode search engine info: %w", err)
+	}
+
+	e := esEngine{name: EngineElasticsearch, version: info.Version.Number}
+	if info.Version.Distribution == EngineOpenSearch || strings.Contains(info.Tagline, "OpenSearch") {
+		e.name = EngineOpenSearch
+	}
+
+	switch {
+	case b.flavour != EngineAuto && b.flavour != e.name:
+		return fmt.Errorf("configured for %s but connected to %s %s", b.flavour, e.name, e.version)
+
+	case e.name == EngineElasticsearch && b.flavour != EngineElasticsearch:
+		// product check is done in auto mode only, forcing the flavour
+		// can be used to connect to proxies that strip the header
+		if versionAtLeast(e.version, 7, 14) && res.Header.Get("X-Elastic-Product") != "Elasticsearch" {
+			return fmt.Errorf("unsupported search engine, product check failed")
+		}
+	}
+
+	b.mux.Lock()
+	b.engine = &e
+	b.mux.Unlock()
+
+	b.log.Info("search engine detected",
+		zap.String("engine", e.name),
+		zap.String("version", e.version),
+	)
+
+	return nil
+}
+
+func (b *esBackend) Engine() (string, string) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	if b.engine == nil {
+		return "", ""
+	}
+
+	return b.engine.name, b.engine.version
+}
+
+// versionAtLeast checks if version (major.minor.patch) is at least major.minor
+func versionAtLeast(version string, major, minor int) bool {
+	pp := strings.SplitN(version, ".", 3)
+	if len(pp) < 2 {
+		return false
+	}
+
+	vMajor, _ := strconv.Atoi(pp[0])
+	vMinor, _ := strconv.Atoi(pp[1])
+
+	return vMajor > major || (vMajor == major && vMinor >= minor)
+}
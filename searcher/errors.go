@@ -0,0 +1,109 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type (
+	// apiError is returned to the client in the error envelope:
+	// {"error": {"code": "...", "message": "..."}}
+	apiError struct {
+		status int
+
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// backendStatusError is returned when search backend
+	// responds with an error status
+	backendStatusError struct {
+		Status int
+		Type   string
+		Reason string
+
+		// type of the error that caused the failure (if reported)
+		Cause string
+	}
+
+	// cdWarning reports part of the response that could not be resolved
+	cdWarning struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func (e *backendStatusError) Error() string {
+	return fmt.Sprintf("search backend responded with an error: %s (type: %s, status: %d)", e.Reason, e.Type, e.Status)
+}
+
+func errBadRequest(err error) *apiError {
+	return &apiError{status: http.StatusBadRequest, Code: "bad_request", Message: err.Error()}
+}
+
+func errUnauthorized(code, msg string) *apiError {
+	return &apiError{status: http.StatusUnauthorized, Code: code, Message: msg}
+}
+
+func errForbidden(code, msg string) *apiError {
+	return &apiError{status: http.StatusForbidden, Code: code, Message: msg}
+}
+
+func errUnavailable(code, msg string) *apiError {
+	return &apiError{status: http.StatusServiceUnavailable, Code: code, Message: msg}
+}
+
+func errCorteza(err error) *apiError {
+	return &apiError{status: http.StatusBadGateway, Code: "corteza_error", Message: err.Error()}
+}
+
+// errBackend classifies search backend failure
+//
+// Error details are not exposed to the client (they are logged) except
+// for requests rejected by the backend; those are caused by request params
+func errBackend(err error) *apiError {
+	var (
+		serr *backendStatusError
+		nerr net.Error
+		oerr *net.OpError
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &nerr) && nerr.Timeout(),
+		errors.As(err, &serr) && serr.Status == http.StatusGatewayTimeout:
+		return &apiError{status: http.StatusGatewayTimeout, Code: "backend_timeout", Message: "search backend did not respond in time"}
+
+	case errors.As(err, &oerr) && oerr.Op == "dial",
+		errors.As(err, &serr) && (serr.Status == http.StatusServiceUnavailable || serr.Status == http.StatusTooManyRequests):
+		return &apiError{status: http.StatusServiceUnavailable, Code: "backend_unavailable", Message: "search backend is unavailable"}
+
+	case errors.As(err, &serr) && serr.Status == http.StatusBadRequest:
+		msg := serr.Reason
+		if msg == "" {
+			msg = "search backend rejected the request"
+		}
+
+		return &apiError{status: http.StatusBadRequest, Code: "bad_request", Message: msg}
+
+	default:
+		return &apiError{status: http.StatusBadGateway, Code: "backend_error", Message: "search backend failed to process the request"}
+	}
+}
+
+// writeError writes error envelope with the status of the error
+func writeError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{e})
+}
@@ -0,0 +1,63 @@
+package searcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestErrBackend(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{
+			name:    "rejected request",
+			err:     fmt.Errorf("invalid search response: %w", &backendStatusError{Status: http.StatusBadRequest, Type: "illegal_argument_exception", Reason: "Text fields are not optimised for operations that require per-document field data"}),
+			status:  http.StatusBadRequest,
+			code:    "bad_request",
+			message: "Text fields are not optimised for operations that require per-document field data",
+		},
+		{
+			name:   "unavailable",
+			err:    &backendStatusError{Status: http.StatusServiceUnavailable},
+			status: http.StatusServiceUnavailable,
+			code:   "backend_unavailable",
+		},
+		{
+			name:   "too many requests",
+			err:    &backendStatusError{Status: http.StatusTooManyRequests},
+			status: http.StatusServiceUnavailable,
+			code:   "backend_unavailable",
+		},
+		{
+			name:   "timeout",
+			err:    fmt.Errorf("search failed: %w", context.DeadlineExceeded),
+			status: http.StatusGatewayTimeout,
+			code:   "backend_timeout",
+		},
+		{
+			name:   "server error",
+			err:    &backendStatusError{Status: http.StatusInternalServerError, Reason: "internal details"},
+			status: http.StatusBadGateway,
+			code:   "backend_error",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := errBackend(c.err)
+			if e.status != c.status || e.Code != c.code {
+				t.Errorf("expected %d %s, got %d %s", c.status, c.code, e.status, e.Code)
+			}
+
+			if c.message != "" && e.Message != c.message {
+				t.Errorf("expected message %q, got %q", c.message, e.Message)
+			}
+		})
+	}
+}
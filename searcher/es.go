@@ -7,15 +7,30 @@ import (
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
-	"github.com/go-chi/jwtauth"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type (
+	esBackend struct {
+		esc *elasticsearch.Client
+		log *zap.Logger
+
+		// configured flavour; auto, elasticsearch or opensearch
+		flavour string
+
+		// field with unique document ID, hits sort tiebreaker
+		tiebreaker string
+
+		mux    sync.RWMutex
+		engine *esEngine
+	}
+
 	esSearchParamsIndex struct {
 		Prefix struct {
 			Index struct {
@@ -60,6 +75,24 @@ type (
 		} `json:"query"`
 
 		Aggregations EsSearchAggrTerms `json:"aggs,omitempty"`
+
+		Sort        []interface{}     `json:"sort,omitempty"`
+		SearchAfter []json.RawMessage `json:"search_after,omitempty"`
+
+		Highlight *esHighlight `json:"highlight,omitempty"`
+
+		Size           int         `json:"size"`
+		From           int         `json:"from,omitempty"`
+		TrackTotalHits bool        `json:"track_total_hits,omitempty"`
+		Source         interface{} `json:"_source,omitempty"`
+	}
+
+	esHighlight struct {
+		// html escapes highlighted text (tags are added as they are)
+		Encoder  string                 `json:"encoder,omitempty"`
+		PreTags  []string               `json:"pre_tags,omitempty"`
+		PostTags []string               `json:"post_tags,omitempty"`
+		Fields   map[string]interface{} `json:"fields"`
 	}
 
 	esSearchAggrTerm struct {
@@ -83,6 +116,23 @@ type (
 		TimedOut     bool                 `json:"timed_out"`
 		Hits         esSearchHits         `json:"hits"`
 		Aggregations esSearchAggregations `json:"aggregations"`
+
+		// set when there are more hits (in the direction of the fetch)
+		// than requested with pagination
+		hasMore bool
+	}
+
+	esMultiSearchResponse struct {
+		Took      int `json:"took"`
+		Responses []struct {
+			esSearchResponse
+
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"responses"`
 	}
 
 	esSearchTotal struct {
@@ -99,6 +149,17 @@ type (
 		Index  string          `json:"_index"`
 		ID     string          `json:"_id"`
 		Source json.RawMessage `json:"_source"`
+
+		// sort values, used for cursor pagination
+		Sort []json.RawMessage `json:"sort,omitempty"`
+
+		// highlighted fragments, indexed by field
+		Highlight map[string][]string `json:"highlight,omitempty"`
+	}
+
+	esTermsBucket struct {
+		Key      string `json:"key"`
+		DocCount int    `json:"doc_count"`
 	}
 
 	esSearchAggregations struct {
@@ -134,103 +195,405 @@ type (
 		//		} `json:"modules"`
 		//	} `json:"buckets"`
 		//} `json:"resource"`
+		Resource struct {
+			DocCountErrorUpperBound int             `json:"doc_count_error_upper_bound"`
+			SumOtherDocCount        int             `json:"sum_other_doc_count"`
+			Buckets                 []esTermsBucket `json:"buckets"`
+		} `json:"resource"`
 		Module struct {
-			DocCountErrorUpperBound int `json:"doc_count_error_upper_bound"`
-			SumOtherDocCount        int `json:"sum_other_doc_count"`
-			Buckets                 []struct {
-				Key      string `json:"key"`
-				DocCount int    `json:"doc_count"`
-			} `json:"buckets"`
+			DocCountErrorUpperBound int             `json:"doc_count_error_upper_bound"`
+			SumOtherDocCount        int             `json:"sum_other_doc_count"`
+			Buckets                 []esTermsBucket `json:"buckets"`
 		} `json:"module"`
 		Namespace struct {
-			DocCountErrorUpperBound int `json:"doc_count_error_upper_bound"`
-			SumOtherDocCount        int `json:"sum_other_doc_count"`
-			Buckets                 []struct {
-				Key      string `json:"key"`
-				DocCount int    `json:"doc_count"`
-			} `json:"buckets"`
+			DocCountErrorUpperBound int             `json:"doc_count_error_upper_bound"`
+			SumOtherDocCount        int             `json:"sum_other_doc_count"`
+			Buckets                 []esTermsBucket `json:"buckets"`
 		} `json:"namespace"`
+
+		// module field aggregations, indexed by field
+		Facets EsSearchAggrResults `json:"-"`
 	}
 
 	searchParams struct {
+		// query variant (hits, namespaces...) used in logs and metrics
+		variant string
+
 		query         string
 		moduleAggs    []string
 		namespaceAggs []string
 		dumpRaw       bool
-		size          int
+		paging        pagination
+		tiebreaker    string
+		highlight     *esHighlight
+		tier          accessTier
+
+		// resource types to search through (all when empty)
+		types []string
+
+		// module fields to aggregate by
+		facets []string
+
+		// module field values to filter by
+		filters map[string][]string
+
+		// IDs of the modules to search through (all when empty)
+		moduleIDs []string
 
 		aggOnly  bool
 		mAggOnly bool
+
+		// aggregate by resource type only
+		rAggOnly bool
 	}
 )
 
-func EsClient(aa []string) (*elasticsearch.Client, error) {
-	return elasticsearch.NewClient(elasticsearch.Config{
-		Addresses:            aa,
-		EnableRetryOnTimeout: true,
-		MaxRetries:           5,
+// EsBackend returns Elasticsearch (or OpenSearch) implementation of the Backend
+func EsBackend(log *zap.Logger, esc *elasticsearch.Client, flavour, tiebreaker string) *esBackend {
+	if flavour == "" {
+		flavour = EngineAuto
+	}
+
+	return &esBackend{esc: esc, log: log, flavour: flavour, tiebreaker: tiebreaker}
+}
+
+func (b *esBackend) Search(ctx context.Context, pp ...searchParams) (rr []*esSearchResponse, err error) {
+	variants := make([]string, len(pp))
+	for i := range pp {
+		variants[i] = pp[i].variant
+	}
+
+	ctx, span := startSpan(ctx, "backend.search", attribute.StringSlice("search.variants", variants))
+	defer func(start time.Time) {
+		// all variants share one round-trip, latency is recorded under the combination
+		// (handlers use only a few) and execution time of each with observeTook
+		observeBackend("msearch:"+strings.Join(variants, "+"), start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	return multiSearch(ctx, b.esc, b.log, b.tiebreaker, pp...)
+}
+
+func (b *esBackend) Suggest(ctx context.Context, p suggestParams) (sr *esSearchResponse, err error) {
+	ctx, span := startSpan(ctx, "backend.suggest")
+	defer func(start time.Time) {
+		observeBackend("suggest", start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	sr = &esSearchResponse{}
+	if err = execSearch(ctx, b.esc, b.log, suggestQuery(ctx, p), sr); err != nil {
+		return
+	}
+
+	observeTook("suggest", sr.Took)
+	return
+}
+
+func (b *esBackend) Aggregate(ctx context.Context, p aggregateParams) (out *cdAggregateResult, err error) {
+	var (
+		// Use the same query (with security filters) as for the search
+		query = searchQuery(ctx, p.search).Query
+	)
+
+	ctx, span := startSpan(ctx, "backend.aggregate", attribute.String("aggregate.type", p.kind))
+	defer func(start time.Time) {
+		observeBackend("aggregate_"+p.kind, start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	out = &cdAggregateResult{Type: p.kind, Field: p.field}
+
+	switch p.kind {
+	case aggregateRange:
+		out.Min, out.Max, err = RangeAggregate(ctx, b.esc, b.log, query, p.field)
+
+	case aggregateCardinality:
+		var count int64
+		if count, err = CardinalityAggregate(ctx, b.esc, b.log, query, p.field); err == nil {
+			out.Count = &count
+		}
+
+	case aggregateComposite:
+		var next map[string]interface{}
+		if out.Buckets, next, err = compositeAggregateAfter(ctx, b.esc, b.log, query, p.field, p.after); err == nil && next != nil {
+			out.After = encodeAfterKey(next)
+		}
+
+	case aggregateDateHistogram:
+		out.Buckets, err = DateHistogramAggregate(ctx, b.esc, b.log, query, p.field, p.interval, p.buckets)
+
+	default:
+		err = fmt.Errorf("unknown aggregation type: %q", p.kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (b *esBackend) Get(ctx context.Context, tier accessTier, id string) (_ *esSearchHit, err error) {
+	var (
+		sr    = &esSearchResponse{}
+		query = baseQuery(ctx, tier)
+	)
+
+	ctx, span := startSpan(ctx, "backend.get")
+	defer func(start time.Time) {
+		observeBackend("get", start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	query.Query.Bool.Must = append(query.Query.Bool.Must, map[string]interface{}{
+		"ids": map[string][]string{"values": {id}},
 	})
+	query.Size = 1
+
+	if err = execSearch(ctx, b.esc, b.log, query, sr); err != nil {
+		return nil, err
+	}
+
+	observeTook("get", sr.Took)
+
+	if len(sr.Hits.Hits) == 0 {
+		return nil, nil
+	}
+
+	return sr.Hits.Hits[0], nil
+}
+
+func (b *esBackend) Ping(ctx context.Context) error {
+	if name, _ := b.Engine(); name == "" {
+		return b.Detect(ctx)
+	}
+
+	res, err := b.esc.Ping(
+		b.esc.Ping.WithContext(ctx),
+	)
+
+	if err = validElasticResponse(b.log, res, err); err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// Health reads cluster health and lists public and private indexes
+func (b *esBackend) Health(ctx context.Context) (*backendHealth, error) {
+	var (
+		h   = &backendHealth{Indexes: tierIndexes()}
+		aux struct {
+			Status string `json:"status"`
+		}
+		indexes []struct {
+			Index string `json:"index"`
+		}
+	)
+
+	res, err := b.esc.Cluster.Health(b.esc.Cluster.Health.WithContext(ctx))
+	if err = validElasticResponse(b.log, res, err); err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(&aux); err != nil {
+		return nil, fmt.Errorf("could not decode cluster health: %w", err)
+	}
+
+	h.Status = aux.Status
+
+	res, err = b.esc.Cat.Indices(
+		b.esc.Cat.Indices.WithContext(ctx),
+		b.esc.Cat.Indices.WithIndex(tierPublic.indexPrefix()+"*", tierPrivate.indexPrefix()+"*"),
+		b.esc.Cat.Indices.WithFormat("json"),
+		b.esc.Cat.Indices.WithH("index"),
+	)
+	if err = validElasticResponse(b.log, res, err); err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(&indexes); err != nil {
+		return nil, fmt.Errorf("could not decode index list: %w", err)
+	}
+
+	for _, i := range indexes {
+		h.count(i.Index)
+	}
+
+	return h, nil
+}
+
+// UnmarshalJSON decodes fixed aggregations and
+// collects module field aggregations into Facets
+func (a *esSearchAggregations) UnmarshalJSON(data []byte) error {
+	type aux esSearchAggregations
+	if err := json.Unmarshal(data, (*aux)(a)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	for name, r := range raw {
+		if !strings.HasPrefix(name, valuesFieldPrefix) {
+			continue
+		}
+
+		var res EsSearchAggrResult
+		if err := json.Unmarshal(r, &res); err != nil {
+			return err
+		}
+
+		if a.Facets == nil {
+			a.Facets = make(EsSearchAggrResults)
+		}
+
+		a.Facets[strings.TrimPrefix(name, valuesFieldPrefix)] = res
+	}
+
+	return nil
 }
 
-func search(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, p searchParams) (*esSearchResponse, error) {
+// multiSearch executes all queries in a single _msearch request
+//
+// Responses are returned in the same order as params; failed query
+// results in a nil response and its error is logged.
+func multiSearch(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, tiebreaker string, pp ...searchParams) ([]*esSearchResponse, error) {
 	var (
-		buf          bytes.Buffer
-		roles        []string
-		userID       uint64
-		_, claims, _ = jwtauth.FromContext(ctx)
+		buf     bytes.Buffer
+		enc     = json.NewEncoder(&buf)
+		dumpRaw bool
 	)
 
-	if _, has := claims["roles"]; has {
-		if rolesStr, is := claims["roles"].(string); is {
-			roles = strings.Split(rolesStr, " ")
+	for _, p := range pp {
+		p.tiebreaker = tiebreaker
+
+		// Header line; indexes are selected with the prefix filter inside the query
+		if err := enc.Encode(struct{}{}); err != nil {
+			return nil, fmt.Errorf("could not encode query header: %q", err)
+		}
+
+		if err := enc.Encode(searchQuery(ctx, p)); err != nil {
+			return nil, fmt.Errorf("could not encode query: %q", err)
 		}
+
+		dumpRaw = dumpRaw || p.dumpRaw
+	}
+
+	log.Debug("executing multi search", zap.String("body", buf.String()))
+
+	reqArgs := []func(*esapi.MsearchRequest){
+		esc.Msearch.WithContext(ctx),
+	}
+
+	if dumpRaw {
+		reqArgs = append(reqArgs, esc.Msearch.WithPretty())
+	}
+
+	// Perform the search request.
+	res, err := esc.Msearch(&buf, reqArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validElasticResponse(log, res, err); err != nil {
+		return nil, fmt.Errorf("invalid search response: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if dumpRaw {
+		// Copy body buf and then restore it
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		res.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+		os.Stdout.Write(bodyBytes)
+	}
+
+	var msr = &esMultiSearchResponse{}
+	if err = json.NewDecoder(res.Body).Decode(msr); err != nil {
+		return nil, err
+	}
+
+	if len(msr.Responses) != len(pp) {
+		return nil, fmt.Errorf("unexpected number of responses: %d, expecting %d", len(msr.Responses), len(pp))
 	}
-	if _, has := claims["sub"]; has {
-		if sub, is := claims["sub"].(string); is {
-			userID, _ = strconv.ParseUint(sub, 10, 64)
+
+	out := make([]*esSearchResponse, len(pp))
+	for i := range msr.Responses {
+		r := &msr.Responses[i]
+		if r.Error != nil {
+			backendQueryErrors.WithLabelValues(pp[i].variant).Inc()
+			log.Error("search failed",
+				zap.String("variant", pp[i].variant),
+				zap.Int("query", i),
+				zap.Int("status", r.Status),
+				zap.String("type", r.Error.Type),
+				zap.String("reason", r.Error.Reason),
+			)
+			continue
 		}
+
+		out[i] = &r.esSearchResponse
+		out[i].paginate(pp[i].paging, pp[i].aggOnly)
+		observeTook(pp[i].variant, r.Took)
+
+		// Print the response status, number of results, and request duration.
+		log.Debug("search completed",
+			zap.String("variant", pp[i].variant),
+			zap.String("query", pp[i].query),
+			zap.String("indexPrefix", pp[i].tier.indexPrefix()),
+			zap.Int("status", r.Status),
+			zap.Int("took", r.Took),
+			zap.Bool("timedOut", r.TimedOut),
+			zap.Int("hits", r.Hits.Total.Value),
+			zap.String("hitsRelation", r.Hits.Total.Relation),
+		)
 	}
 
-	noQ := len(p.query) == 0
-	noNSFilter := len(p.namespaceAggs) == 0
-	//noMFilter := len(p.moduleAggs) == 0
-	sqs := esSimpleQueryString{}
-	sqs.Wrap.Query = p.query
+	return out, nil
+}
 
-	query := esSearchParams{}
-	index := esSearchParamsIndex{}
+// baseQuery returns query restricted to indexes of the access tier
+// and to the documents user is allowed to see
+func baseQuery(ctx context.Context, tier accessTier) (query esSearchParams) {
+	var (
+		_, roles = identity(ctx)
+		index    = esSearchParamsIndex{}
+	)
 
 	// Decide what indexes we can use
-	if userID == 0 {
-		// Missing, invalid, expired access token (JWT)
-		//index.Prefix.Index.Value = "corteza-public-"
-		// fixme revert this, temp fix for searching
-		index.Prefix.Index.Value = "corteza-private-"
-	} else {
-		// Authenticated user
-		index.Prefix.Index.Value = "corteza-private-"
-
-		//query.Query.Bool.Filter = []interface{}{
-		//	//map[string]map[string]interface{}{
-		//	//	"exists": {"field": []string{"security.allowedRoles", "security.deniedRoles"}},
-		//	//},
-		//	map[string]map[string]interface{}{
-		//		// Skip all documents that do not have baring roles in the allow list
-		//		"terms": {"security.allowedRoles": roles},
-		//	},
-		//}
-		//query.Query.Bool.MustNot = []interface{}{
-		//	map[string]map[string]interface{}{
-		//		// Skip all documents that have baring roles in the deny list
-		//		"terms": {"security.deniedRoles": roles},
-		//	},
-		//}
-		_ = roles
+	index.Prefix.Index.Value = tier.indexPrefix()
+
+	if tier != tierPublic {
+		// Security filters are added to the filter context of every query variant
+		// (hits and aggregations) so that facet counts reflect only
+		// documents the user is allowed to see.
+		query.Query.Bool.Filter = append(query.Query.Bool.Filter, allowedRolesFilter(roles))
+		query.Query.Bool.MustNot = append(query.Query.Bool.MustNot, deniedRolesFilter(roles))
 	}
 
 	// Query MUST filter
 	query.Query.Bool.Must = []interface{}{index}
 
+	return
+}
+
+// searchQuery builds search request body from the search params
+func searchQuery(ctx context.Context, p searchParams) esSearchParams {
+	noQ := len(p.query) == 0
+	noNSFilter := len(p.namespaceAggs) == 0
+	//noMFilter := len(p.moduleAggs) == 0
+	sqs := esSimpleQueryString{}
+	sqs.Wrap.Query = p.query
+
+	query := baseQuery(ctx, p.tier)
+
 	// Aggregations V1.0
 	//if len(p.aggregations) > 0 {
 	//	query.Aggregations = make(map[string]esSearchAggr)
@@ -300,21 +663,50 @@ func search(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, p s
 	//if noQ == 0 && len(p.moduleAggs) == 0 && len(p.namespaceAggs) == 0 {
 	//	query.Query.DisMax.Queries = append(query.Query.DisMax.Queries, index)
 	//}
-	query.Aggregations = make(map[string]esSearchAggr)
-	query.Aggregations["namespace"] = esSearchAggr{
-		Terms: esSearchAggrTerm{
-			Field: "namespace.name.keyword",
-			Size:  999,
-		},
+
+	if len(p.types) > 0 {
+		query.Query.Bool.Filter = append(query.Query.Bool.Filter, map[string]interface{}{
+			"terms": map[string][]string{"resourceType.keyword": p.types},
+		})
+	}
+
+	if len(p.moduleIDs) > 0 {
+		query.Query.Bool.Filter = append(query.Query.Bool.Filter, map[string]interface{}{
+			"terms": map[string][]string{"module.moduleId.keyword": p.moduleIDs},
+		})
+	}
+
+	for f, vv := range p.filters {
+		query.Query.Bool.Filter = append(query.Query.Bool.Filter, map[string]interface{}{
+			"terms": map[string][]string{valuesFieldPrefix + f + ".keyword": vv},
+		})
 	}
 
-	if !noQ || !noNSFilter {
-		query.Aggregations["module"] = esSearchAggr{
+	query.Aggregations = make(map[string]esSearchAggr)
+
+	if p.rAggOnly {
+		query.Aggregations["resource"] = esSearchAggr{
+			Terms: esSearchAggrTerm{
+				Field: "resourceType.keyword",
+				Size:  999,
+			},
+		}
+	} else {
+		query.Aggregations["namespace"] = esSearchAggr{
 			Terms: esSearchAggrTerm{
-				Field: "module.name.keyword",
+				Field: "namespace.name.keyword",
 				Size:  999,
 			},
 		}
+
+		if !noQ || !noNSFilter {
+			query.Aggregations["module"] = esSearchAggr{
+				Terms: esSearchAggrTerm{
+					Field: "module.name.keyword",
+					Size:  999,
+				},
+			}
+		}
 	}
 
 	//query.Aggregations["resource"] = esSearchAggr{
@@ -345,76 +737,79 @@ func search(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, p s
 	//}
 
 	// Aggregations V2.0
-	//if len(p.aggregations) > 0 {
-	//	query.Aggregations = (Aggregations{}).encodeTerms(p.aggregations)
-	//}
+	if !p.aggOnly && len(p.facets) > 0 {
+		ff := make([]string, len(p.facets))
+		for i, f := range p.facets {
+			ff[i] = valuesFieldPrefix + f
+		}
 
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		return nil, fmt.Errorf("could not encode query: %q", err)
+		for name, agg := range (Aggregations{}).encodeTerms(ff) {
+			query.Aggregations[name] = agg
+		}
 	}
-	fmt.Println(">>> ", buf.String())
 
-	// Why set size to 999? default value for size is 10,
-	// so we needed to set value till we add (@todo) pagination to search result
-	if p.size == 0 {
-		p.size = 999
-	}
+	query.TrackTotalHits = true
 
-	sReqArgs := []func(*esapi.SearchRequest){
-		esc.Search.WithContext(ctx),
-		esc.Search.WithBody(&buf),
-		esc.Search.WithTrackTotalHits(true),
-		//esc.Search.WithScroll(),
-		esc.Search.WithSize(p.size),
-		//esc.Search.WithFrom(0), // paging (offset)
-		//esc.Search.WithExplain(true), // debug
+	if !p.aggOnly {
+		// Fetch one hit more than requested to see if there is another page
+		query.Size = p.paging.perPage + 1
+
+		query.Highlight = p.highlight
+		query.Sort = hitsSort(p.paging.cursor != nil && p.paging.cursor.Reverse, p.tiebreaker)
+		if p.paging.cursor != nil {
+			query.SearchAfter = p.paging.cursor.After
+		} else {
+			query.From = p.paging.from()
+		}
 	}
 
 	if p.dumpRaw {
-		sReqArgs = append(
-			sReqArgs,
-			esc.Search.WithSourceExcludes("security"),
-			esc.Search.WithPretty(),
-		)
+		query.Source = map[string][]string{"excludes": {"security"}}
 	}
 
-	// Perform the search request.
-	res, err := esc.Search(sReqArgs...)
+	return query
+}
 
-	if err != nil {
-		return nil, err
+// paginate trims the extra hit fetched to detect next page
+// and restores order of hits fetched in reverse
+func (sr *esSearchResponse) paginate(p pagination, aggOnly bool) {
+	if aggOnly {
+		return
 	}
 
-	if err = validElasticResponse(log, res, err); err != nil {
-		return nil, fmt.Errorf("invalid search response: %w", err)
+	if len(sr.Hits.Hits) > p.perPage {
+		sr.Hits.Hits = sr.Hits.Hits[:p.perPage]
+		sr.hasMore = true
 	}
 
-	defer res.Body.Close()
-
-	if p.dumpRaw {
-		// Copy body buf and then restore it
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		res.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-		os.Stdout.Write(bodyBytes)
+	if p.cursor != nil && p.cursor.Reverse {
+		for i, j := 0, len(sr.Hits.Hits)-1; i < j; i, j = i+1, j-1 {
+			sr.Hits.Hits[i], sr.Hits.Hits[j] = sr.Hits.Hits[j], sr.Hits.Hits[i]
+		}
 	}
+}
 
-	var sr = &esSearchResponse{}
-	if err = json.NewDecoder(res.Body).Decode(sr); err != nil {
-		return nil, err
+// execSearch executes a single search request and decodes response into dst
+func execSearch(ctx context.Context, esc *elasticsearch.Client, log *zap.Logger, query interface{}, dst interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		return fmt.Errorf("could not encode query: %q", err)
 	}
 
-	// Print the response status, number of results, and request duration.
-	log.Debug("search completed",
-		zap.String("query", sqs.Wrap.Query),
-		zap.String("indexPrefix", index.Prefix.Index.Value),
-		zap.String("status", res.Status()),
-		zap.Int("took", sr.Took),
-		zap.Bool("timedOut", sr.TimedOut),
-		zap.Int("hits", sr.Hits.Total.Value),
-		zap.String("hitsRelation", sr.Hits.Total.Relation),
+	log.Debug("executing search", zap.String("body", buf.String()))
+
+	res, err := esc.Search(
+		esc.Search.WithContext(ctx),
+		esc.Search.WithBody(&buf),
 	)
 
-	return sr, nil
+	if err = validElasticResponse(log, res, err); err != nil {
+		return fmt.Errorf("invalid search response: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(dst)
 }
 
 func validElasticResponse(log *zap.Logger, res *esapi.Response, err error) error {
@@ -426,15 +821,18 @@ func validElasticResponse(log *zap.Logger, res *esapi.Response, err error) error
 		defer res.Body.Close()
 		var rsp struct {
 			Error struct {
-				Type   string
-				Reason string
+				Type     string
+				Reason   string
+				CausedBy struct {
+					Type string
+				} `json:"caused_by"`
 			}
 		}
 
 		if err := json.NewDecoder(res.Body).Decode(&rsp); err != nil {
-			return fmt.Errorf("could not parse response body: %w", err)
+			return &backendStatusError{Status: res.StatusCode, Reason: fmt.Sprintf("could not parse response body: %v", err)}
 		} else {
-			return fmt.Errorf("search backend responded with an error: %s (type: %s, status: %s)", rsp.Error.Reason, rsp.Error.Type, res.Status())
+			return &backendStatusError{Status: res.StatusCode, Type: rsp.Error.Type, Cause: rsp.Error.CausedBy.Type, Reason: rsp.Error.Reason}
 		}
 	}
 
@@ -0,0 +1,169 @@
+package searcher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type (
+	// EsOptions configure connection to the Elasticsearch cluster
+	EsOptions struct {
+		Addresses []string
+
+		// basic auth
+		Username string
+		Password string
+
+		// base64 encoded API key; overrides username and password
+		APIKey string
+
+		// Elastic Cloud deployment; used instead of addresses
+		CloudID string
+
+		// PEM encoded CA certificate(s) to verify the cluster with
+		CACertFile string
+
+		// client certificate and key for mutual TLS
+		ClientCertFile string
+		ClientKeyFile  string
+
+		// SHA256 fingerprint (hex, optionally colon delimited) of the
+		// certificate that cluster must present
+		CertFingerprint string
+	}
+)
+
+func EsClient(opt EsOptions) (*elasticsearch.Client, error) {
+	tlsConfig, err := esTLSConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := elasticsearch.Config{
+		Addresses:            opt.Addresses,
+		Username:             opt.Username,
+		Password:             opt.Password,
+		APIKey:               opt.APIKey,
+		CloudID:              opt.CloudID,
+		EnableRetryOnTimeout: true,
+		MaxRetries:           5,
+	}
+
+	if cfg.CloudID != "" {
+		// client refuses to accept both
+		cfg.Addresses = nil
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+
+	cfg.Transport = &tracedTransport{base: transport, opaqueID: true}
+
+	return elasticsearch.NewClient(cfg)
+}
+
+// esTLSConfig returns TLS configuration or nil when defaults can be used
+func esTLSConfig(opt EsOptions) (*tls.Config, error) {
+	if opt.CACertFile == "" && opt.ClientCertFile == "" && opt.CertFingerprint == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opt.CACertFile != "" {
+		pem, err := ioutil.ReadFile(opt.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificate: %w", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", opt.CACertFile)
+		}
+	}
+
+	if opt.ClientCertFile != "" || opt.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.ClientCertFile, opt.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if opt.CertFingerprint != "" {
+		fingerprint := strings.ToLower(strings.ReplaceAll(opt.CertFingerprint, ":", ""))
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid certificate fingerprint, expecting SHA256 in hex")
+		}
+
+		if cfg.RootCAs == nil {
+			// Pinned certificate is usually self-signed,
+			// fingerprint check replaces chain verification
+			cfg.InsecureSkipVerify = true
+		}
+
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinned(rawCerts, fingerprint)
+		}
+	}
+
+	return cfg, nil
+}
+
+// verifyPinned checks if server certificate is the pinned one
+// or if it is issued by the pinned certificate
+//
+// Pinned certificate anywhere else in the presented chain is not
+// enough; it is public and can be sent along with any certificate.
+func verifyPinned(rawCerts [][]byte, fingerprint string) error {
+	var (
+		roots         = x509.NewCertPool()
+		intermediates = x509.NewCertPool()
+		leaf          *x509.Certificate
+		pinned        bool
+	)
+
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid server certificate: %w", err)
+		}
+
+		sum := sha256.Sum256(raw)
+		switch {
+		case hex.EncodeToString(sum[:]) == fingerprint:
+			if i == 0 {
+				return nil
+			}
+
+			roots.AddCert(cert)
+			pinned = true
+		case i == 0:
+			leaf = cert
+		default:
+			intermediates.AddCert(cert)
+		}
+	}
+
+	if leaf == nil || !pinned {
+		return fmt.Errorf("certificate fingerprint mismatch")
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("server certificate is not issued by the pinned certificate: %w", err)
+	}
+
+	return nil
+}
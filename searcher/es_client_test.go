@@ -0,0 +1,87 @@
+package searcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert creates certificate signed by the parent (self-signed when nil)
+func testCert(t *testing.T, cn string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw, cert, key
+}
+
+func fingerprintOf(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyPinned(t *testing.T) {
+	var (
+		caRaw, ca, caKey = testCert(t, "ca", true, nil, nil)
+		leafRaw, _, _    = testCert(t, "es", false, ca, caKey)
+		selfRaw, _, _    = testCert(t, "es", false, nil, nil)
+		evilRaw, _, _    = testCert(t, "evil", false, nil, nil)
+	)
+
+	cases := []struct {
+		name        string
+		chain       [][]byte
+		fingerprint string
+		valid       bool
+	}{
+		{"pinned self-signed", [][]byte{selfRaw}, fingerprintOf(selfRaw), true},
+		{"pinned leaf", [][]byte{leafRaw, caRaw}, fingerprintOf(leafRaw), true},
+		{"issued by pinned CA", [][]byte{leafRaw, caRaw}, fingerprintOf(caRaw), true},
+		{"not pinned", [][]byte{selfRaw}, fingerprintOf(leafRaw), false},
+		{"pinned CA along with foreign leaf", [][]byte{evilRaw, caRaw}, fingerprintOf(caRaw), false},
+		{"pinned leaf along with foreign leaf", [][]byte{evilRaw, selfRaw}, fingerprintOf(selfRaw), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := verifyPinned(c.chain, c.fingerprint); (err == nil) != c.valid {
+				t.Errorf("expected valid=%v, got error: %v", c.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// healthCheck is a single readiness check
+	//
+	// Returned details are included in the report as they are
+	healthCheck struct {
+		name string
+		fn   func(ctx context.Context) (details interface{}, err error)
+
+		// failed check only warns and does not affect readiness
+		optional bool
+	}
+
+	healthResult struct {
+		Status    string      `json:"status"`
+		LatencyMs int64       `json:"latencyMs"`
+		Message   string      `json:"message,omitempty"`
+		Details   interface{} `json:"details,omitempty"`
+	}
+)
+
+const (
+	readinessTimeout = 5 * time.Second
+
+	checkOk   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// tierIndexes returns index counters for public and private tier
+func tierIndexes() map[string]int {
+	return map[string]int{
+		tierPublic.indexPrefix():  0,
+		tierPrivate.indexPrefix(): 0,
+	}
+}
+
+// count increases the counter of the tier the index belongs to
+func (h *backendHealth) count(index string) {
+	for prefix := range h.Indexes {
+		if strings.HasPrefix(index, prefix) {
+			h.Indexes[prefix]++
+		}
+	}
+}
+
+// Liveness reports that the process is up and serving requests
+//
+// Dependencies are not checked; see Readiness
+func (h handlers) Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"alive"}` + "\n"))
+}
+
+// Readiness checks search backend, indexes and Corteza API
+//
+// Responds with 503 when any of the required checks fails
+func (h handlers) Readiness(w http.ResponseWriter, r *http.Request) {
+	var (
+		out = struct {
+			Status string                   `json:"status"`
+			Checks map[string]*healthResult `json:"checks"`
+		}{Status: "ready"}
+
+		status = http.StatusOK
+	)
+
+	out.Checks = runChecks(r.Context(), h.checks()...)
+
+	backendUp.Set(1)
+	if out.Checks["backend"].Status == checkFail {
+		backendUp.Set(0)
+	}
+
+	for name, res := range out.Checks {
+		if res.Status != checkFail {
+			continue
+		}
+
+		h.log.Warn("readiness check failed", zap.String("check", name), zap.String("message", res.Message))
+		out.Status = "not_ready"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func (h handlers) checks() []healthCheck {
+	var (
+		// indexes are read with the backend health check
+		cached    *backendHealth
+		cachedErr error
+		once      sync.Once
+
+		health = func(ctx context.Context) (*backendHealth, error) {
+			once.Do(func() { cached, cachedErr = h.backend.Health(ctx) })
+			return cached, cachedErr
+		}
+	)
+
+	return []healthCheck{
+		{
+			name: "backend",
+			fn: func(ctx context.Context) (interface{}, error) {
+				bh, err := health(ctx)
+				if err != nil {
+					return nil, err
+				}
+
+				name, version := h.backend.Engine()
+				details := map[string]string{"status": bh.Status, "engine": name, "version": version}
+
+				if bh.Status == "red" {
+					return details, fmt.Errorf("cluster status is red")
+				}
+
+				return details, nil
+			},
+		},
+		{
+			name:     "indexes",
+			optional: true,
+			fn: func(ctx context.Context) (interface{}, error) {
+				bh, err := health(ctx)
+				if err != nil {
+					return nil, err
+				}
+
+				var missing []string
+				for prefix, n := range bh.Indexes {
+					if n == 0 {
+						missing = append(missing, prefix+"*")
+					}
+				}
+
+				if len(missing) > 0 {
+					return bh.Indexes, fmt.Errorf("no indexes matching %s", strings.Join(missing, ", "))
+				}
+
+				return bh.Indexes, nil
+			},
+		},
+		{
+			name: "cortezaApi",
+			fn: func(ctx context.Context) (interface{}, error) {
+				status, err := h.api.ping(ctx)
+				if status == 0 {
+					return nil, err
+				}
+
+				return map[string]int{"status": status}, err
+			},
+		},
+		{
+			name: "cortezaToken",
+			fn: func(ctx context.Context) (interface{}, error) {
+				_, err := h.api.tokens.Token(ctx)
+				return nil, err
+			},
+		},
+	}
+}
+
+// runChecks runs all checks concurrently
+//
+// Checks that do not finish in time are reported as failed
+func runChecks(ctx context.Context, cc ...healthCheck) map[string]*healthResult {
+	var (
+		out = make(map[string]*healthResult, len(cc))
+		mux sync.Mutex
+		wg  sync.WaitGroup
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	for _, c := range cc {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+
+			type result struct {
+				details interface{}
+				err     error
+			}
+
+			var (
+				res   = &healthResult{Status: checkOk}
+				start = time.Now()
+				done  = make(chan result, 1)
+				err   error
+			)
+
+			go func() {
+				details, err := c.fn(ctx)
+				done <- result{details, err}
+			}()
+
+			select {
+			case r := <-done:
+				res.Details, err = r.details, r.err
+			case <-ctx.Done():
+				err = fmt.Errorf("check did not finish in %s", readinessTimeout)
+			}
+
+			res.LatencyMs = time.Since(start).Milliseconds()
+
+			if err != nil {
+				res.Status = checkFail
+				if c.optional {
+					res.Status = checkWarn
+				}
+
+				res.Message = err.Error()
+			}
+
+			mux.Lock()
+			out[c.name] = res
+			mux.Unlock()
+		}(c)
+	}
+
+	wg.Wait()
+	return out
+}
@@ -0,0 +1,92 @@
+package searcher
+
+import (
+	"strings"
+)
+
+const (
+	defaultHighlightPreTag  = "<em>"
+	defaultHighlightPostTag = "</em>"
+
+	// prefix of the record value fields in the indexed document
+	valuesFieldPrefix = "values."
+)
+
+// highlight returns highlight request for the search string
+//
+// Names (of namespaces and modules) and all record fields configured
+// in the discovery meta of the modules are highlighted.
+func (h handlers) highlight(searchString string, moduleMeta map[string][]string) *esHighlight {
+	if len(searchString) == 0 {
+		// nothing to highlight
+		return nil
+	}
+
+	var (
+		ff = map[string]bool{"name": true}
+		hl = &esHighlight{
+			Encoder:  "html",
+			PreTags:  []string{h.opt.HighlightPreTag},
+			PostTags: []string{h.opt.HighlightPostTag},
+			Fields:   make(map[string]interface{}),
+		}
+	)
+
+	if hl.PreTags[0] == "" {
+		hl.PreTags[0] = defaultHighlightPreTag
+	}
+
+	if hl.PostTags[0] == "" {
+		hl.PostTags[0] = defaultHighlightPostTag
+	}
+
+	for _, fields := range moduleMeta {
+		for _, f := range fields {
+			ff[valuesFieldPrefix+f] = true
+		}
+	}
+
+	for f := range ff {
+		hl.Fields[f] = struct{}{}
+	}
+
+	return hl
+}
+
+// allowedHighlight removes highlighted record values of the fields not in the list
+func allowedHighlight(hl map[string][]string, fields []string) map[string][]string {
+	if len(hl) == 0 {
+		return hl
+	}
+
+	allowed := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		allowed[valuesFieldPrefix+f] = true
+	}
+
+	out := make(map[string][]string, len(hl))
+	for f, fragments := range hl {
+		if strings.HasPrefix(f, valuesFieldPrefix) && !allowed[f] {
+			continue
+		}
+
+		out[f] = fragments
+	}
+
+	return out
+}
+
+// convHighlight converts highlighted fragments from the backend
+// into module field => fragments
+func convHighlight(hl map[string][]string) map[string][]string {
+	if len(hl) == 0 {
+		return nil
+	}
+
+	out := make(map[string][]string, len(hl))
+	for f, fragments := range hl {
+		out[strings.TrimPrefix(f, valuesFieldPrefix)] = fragments
+	}
+
+	return out
+}
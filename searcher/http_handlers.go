@@ -4,21 +4,45 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/davecgh/go-spew/spew"
-	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/go-chi/chi"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 var _ = spew.Dump
 
 type (
 	handlers struct {
-		log *zap.Logger
-		esc *elasticsearch.Client
-		api *apiClient
+		log     *zap.Logger
+		backend Backend
+		api     *apiClient
+		meta    *metaCache
+		opt     Options
+	}
+
+	Options struct {
+		// Users with any of these roles get protected tier
+		// (private indexes + protected discovery meta result config)
+		ProtectedRoles []string
+
+		// Users with any of these roles can invalidate cached metadata
+		MetadataRoles []string
+
+		// Tags wrapped around highlighted text in hits
+		HighlightPreTag  string
+		HighlightPostTag string
+
+		// Omit records of modules without result configuration
+		// instead of returning them without values
+		OmitUnconfiguredRecords bool
+
+		// Reject requests without a valid access token
+		// (health checks, sandbox and metrics remain public)
+		RequireAuth bool
 	}
 
 	cResponse struct {
@@ -31,6 +55,9 @@ type (
 				ModuleID uint64         `json:",string"`
 				Handle   string         `json:"handle"`
 				Meta     types.JSONText `json:"meta"`
+				Fields   []struct {
+					Name string `json:"name"`
+				} `json:"fields"`
 			} `json:"set,omitempty"`
 		} `json:"response,omitempty"`
 	}
@@ -49,50 +76,128 @@ type (
 		Protected struct {
 			Result []Result `json:"result"`
 		} `json:"protected"`
+
+		// Module fields (select, status, owner...) with term aggregations
+		// when search is filtered by the module
+		Facets []string `json:"facets,omitempty"`
 	}
 
 	Result struct {
 		Lang   string   `json:"lang"`
 		Fields []string `json:"fields"`
+
+		// Field => roles; value of the listed field is returned
+		// only to users with at least one of the roles
+		Roles map[string][]string `json:"roles,omitempty"`
+
+		// Max number of values returned per record
+		Limit int `json:"limit,omitempty"`
+
 		// @todo? TBD? excludeModuleFields, includeModuleFields <- if passed filter module field accordingly.
 	}
 )
 
+// results returns result configuration for the given access tier
+//
+// Protected tier falls back to private result configuration
+// when module does not have protected one.
+func (m ModuleMeta) results(t accessTier) []Result {
+	switch t {
+	case tierProtected:
+		if len(m.Protected.Result) > 0 {
+			return m.Protected.Result
+		}
+		return m.Private.Result
+	case tierPrivate:
+		return m.Private.Result
+	default:
+		return m.Public.Result
+	}
+}
+
 //func (m moduleMeta) Read(p []byte) (n int, err error) {
 //	panic("implement me")
 //}
 
-func Handlers(r chi.Router, log *zap.Logger, esc *elasticsearch.Client, api *apiClient) *handlers {
+func Handlers(r chi.Router, log *zap.Logger, backend Backend, api *apiClient, meta *metaCache, opt Options) *handlers {
 	h := &handlers{
-		esc: esc,
-		log: log,
-		api: api,
+		backend: backend,
+		log:     log,
+		api:     api,
+		meta:    meta,
+		opt:     opt,
 	}
 
-	r.Use()
+	r.Use(traceRequests, instrument)
 
 	r.Get("/healthcheck", h.Healthcheck)
+	r.Get("/healthz", h.Liveness)
+	r.Get("/readyz", h.Readiness)
 	r.Get("/sandbox", h.Sandbox)
-	r.Get("/", h.Search)
-	//r.Get("/suggest", h.Suggest)
+	r.Handle("/metrics", promhttp.Handler())
+
+	r.Group(func(r chi.Router) {
+		if opt.RequireAuth {
+			r.Use(authenticator)
+		}
+
+		r.Get("/", h.Search)
+		r.Post("/metadata/invalidate", h.InvalidateMetadata)
+		r.Get("/suggest", h.Suggest)
+		r.Get("/aggregate", h.Aggregate)
+	})
 
 	return h
 }
 
 func (h handlers) Healthcheck(w http.ResponseWriter, r *http.Request) {
-	res, err := h.esc.Ping(
-		h.esc.Ping.WithContext(r.Context()),
+	w.Header().Set("Content-Type", "application/json")
+
+	var (
+		out = struct {
+			Status  string `json:"status"`
+			Engine  string `json:"engine,omitempty"`
+			Version string `json:"version,omitempty"`
+		}{Status: "healthy"}
 	)
 
-	if validElasticResponse(h.log, res, err) != nil {
+	backendUp.Set(1)
+	if err := h.backend.Ping(r.Context()); err != nil {
+		h.log.Warn("backend ping failed", zap.Error(err))
+		backendUp.Set(0)
+		out.Status = "unhealthy"
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = fmt.Fprintf(w, "unhealthy")
+	}
+
+	out.Engine, out.Version = h.backend.Engine()
+
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// InvalidateMetadata drops cached namespace & module metadata and reloads it
+//
+// Available to users with one of the metadata roles only
+func (h handlers) InvalidateMetadata(w http.ResponseWriter, r *http.Request) {
+	userID, roles := identity(r.Context())
+	if userID == 0 {
+		writeAuthError(w, errUnauthorized("token_missing", "access token is required"))
+		return
+	}
+
+	if len(h.opt.MetadataRoles) == 0 || !hasAnyRole(roles, h.opt.MetadataRoles) {
+		writeError(w, errForbidden("role_required", "metadata can be invalidated by operators only"))
 		return
 	}
 
-	defer res.Body.Close()
+	h.meta.invalidate()
+
+	if _, err := h.meta.refresh(); err != nil {
+		h.log.Error("failed to reload metadata", zap.Error(err))
+		writeError(w, errCorteza(err))
+		return
+	}
 
-	_, _ = fmt.Fprintf(w, "healthy")
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h handlers) Sandbox(w http.ResponseWriter, r *http.Request) {
@@ -107,14 +212,43 @@ func (h handlers) Search(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = r.ParseForm()
 
-	size := 0
-	if len(r.FormValue("size")) > 0 {
-		size, _ = strconv.Atoi(r.FormValue("size"))
+	pg, err := paging(r)
+	if err != nil {
+		writeError(w, errBadRequest(err))
+		return
+	}
+
+	types, err := resourceTypes(r)
+	if err != nil {
+		writeError(w, errBadRequest(err))
+		return
+	}
+
+	vLimit, err := valuesLimit(r)
+	if err != nil {
+		writeError(w, errBadRequest(err))
+		return
+	}
+
+	// parts of the response that could not be resolved
+	warnings := []cdWarning{}
+
+	meta, err := h.meta.get()
+	if err != nil {
+		h.log.Error("failed to load metadata", zap.Error(err))
+		meta = &metadata{}
+		warnings = append(warnings, cdWarning{
+			Code:    "metadata_unavailable",
+			Message: "module configuration could not be loaded; labels, facets and record values are not resolved",
+		})
 	}
 
-	//searchString := r.FormValue("q")
 	var (
-		ctx = r.Context()
+		ctx      = r.Context()
+		tier     = accessTierFor(ctx, h.opt.ProtectedRoles)
+		_, roles = identity(ctx)
+		facets   = meta.facetFields(tier, roles, r.Form["moduleAggs"])
+
 		// fixme cleanup make struct or something
 		searchString  = r.FormValue("q")
 		moduleAggs    = r.Form["moduleAggs"]
@@ -124,243 +258,287 @@ func (h handlers) Search(w http.ResponseWriter, r *http.Request) {
 		aggregation   *esSearchResponse
 		nsAggregation *esSearchResponse
 		mAggregation  *esSearchResponse
-		err           error
-
-		nsReq      *http.Request
-		nsRes      *http.Response
-		mReq       *http.Request
-		mRes       *http.Response
-		nsResponse cResponse
-		mResponse  cResponse
-		moduleMap  = make(map[string][]string)
-
-		nsHandleMap = make(map[string]string)
-		mHandleMap  = make(map[string]string)
+		rAggregation  *esSearchResponse
+
+		moduleMap   = meta.resultFields(tier, roles, vLimit)
+		nsHandleMap = meta.nsHandles
+		mHandleMap  = meta.mHandles
 	)
-	results, err = search(ctx, h.esc, h.log, searchParams{
-		query:         searchString,
-		moduleAggs:    moduleAggs,
-		namespaceAggs: namespaceAggs,
-		size:          size,
-		dumpRaw:       r.FormValue("dump") != "",
-	})
 
+	filters, err := fieldFilters(r, facets)
 	if err != nil {
-		h.log.Error("could not execute search", zap.Error(err))
+		writeError(w, errBadRequest(err))
+		return
 	}
 
+	var (
+		dumpRaw = r.FormValue("dump") != ""
+
+		// All queries are sent to the backend in one round-trip;
+		// hits query is always first, aggregation only when there is no search string
+		pp = []searchParams{
+			{
+				variant:       "hits",
+				tier:          tier,
+				query:         searchString,
+				moduleAggs:    moduleAggs,
+				namespaceAggs: namespaceAggs,
+				types:         types,
+				facets:        facets,
+				filters:       filters,
+				paging:        pg,
+				highlight:     h.highlight(searchString, moduleMap),
+				dumpRaw:       dumpRaw,
+			},
+			// append all namespace agg with counts no matter what
+			{
+				variant: "namespaces",
+				tier:    tier,
+				dumpRaw: dumpRaw,
+				aggOnly: true,
+			},
+			{
+				variant:       "modules",
+				tier:          tier,
+				dumpRaw:       dumpRaw,
+				query:         searchString,
+				namespaceAggs: namespaceAggs,
+				types:         types,
+				filters:       filters,
+				aggOnly:       true,
+				mAggOnly:      true,
+			},
+			// resource type facet, not narrowed by the types filter
+			{
+				variant:       "resources",
+				tier:          tier,
+				dumpRaw:       dumpRaw,
+				query:         searchString,
+				moduleAggs:    moduleAggs,
+				namespaceAggs: namespaceAggs,
+				aggOnly:       true,
+				rAggOnly:      true,
+			},
+		}
+	)
+
 	if len(searchString) == 0 {
-		aggregation, err = search(ctx, h.esc, h.log, searchParams{
-			size:          size,
-			dumpRaw:       r.FormValue("dump") != "",
+		pp = append(pp, searchParams{
+			variant:       "aggregation",
+			tier:          tier,
+			dumpRaw:       dumpRaw,
 			namespaceAggs: namespaceAggs,
+			types:         types,
+			filters:       filters,
 			aggOnly:       true,
 		})
-		if err != nil {
-			h.log.Error("could not execute aggregation search", zap.Error(err))
-		}
 	}
 
-	// append all namespace agg with counts no matter what
-	nsAggregation, err = search(ctx, h.esc, h.log, searchParams{
-		size:    size,
-		dumpRaw: r.FormValue("dump") != "",
-		aggOnly: true,
-	})
+	rr, err := h.backend.Search(ctx, pp...)
+	if err == nil && rr[0] == nil {
+		err = fmt.Errorf("hits query failed")
+	}
+
 	if err != nil {
-		h.log.Error("could not execute aggregation search", zap.Error(err))
+		h.log.Error("could not execute search", zap.Error(err))
+		writeError(w, errBackend(err))
+		return
 	}
-	if len(searchString) == 0 {
-		if aggregation != nil && nsAggregation != nil {
-			aggregation.Aggregations.Namespace = nsAggregation.Aggregations.Namespace
-		}
-	} else {
-		//if results != nil && nsAggregation != nil {
-		//	nsMap := make(map[string]struct {
-		//		Key      string `json:"key"`
-		//		DocCount int    `json:"doc_count"`
-		//	})
-		//	for _, bucket := range results.Aggregations.Namespace.Buckets {
-		//		nsMap[bucket.Key] = bucket
-		//	}
-		//
-		//	var buckets []struct {
-		//		Key      string `json:"key"`
-		//		DocCount int    `json:"doc_count"`
-		//	}
-		//	for _, bucket := range nsAggregation.Aggregations.Namespace.Buckets {
-		//		val, ok := nsMap[bucket.Key]
-		//		if ok {
-		//			val.DocCount = nsMap[bucket.Key].DocCount
-		//		} else {
-		//			val.Key = bucket.Key
-		//			val.DocCount = 0
-		//		}
-		//		buckets = append(buckets, val)
-		//	}
-		//
-		//	results.Aggregations.Namespace.Buckets = buckets
-		//}
-	}
-	// append namespace agg response which are not in es response
-	if results != nil && len(namespaceAggs) > 0 {
-		nsMap := make(map[string]struct {
-			Key      string `json:"key"`
-			DocCount int    `json:"doc_count"`
+
+	results, nsAggregation, mAggregation, rAggregation = rr[0], rr[1], rr[2], rr[3]
+	if len(rr) > 4 {
+		aggregation = rr[4]
+	}
+
+	if failed := failedVariants(pp, rr); len(failed) > 0 {
+		warnings = append(warnings, cdWarning{
+			Code:    "facets_unavailable",
+			Message: "facets could not be resolved: " + strings.Join(failed, ", "),
 		})
-		var bb []struct {
-			Key      string `json:"key"`
-			DocCount int    `json:"doc_count"`
-		}
-		for _, b := range results.Aggregations.Namespace.Buckets {
-			nsMap = map[string]struct {
-				Key      string `json:"key"`
-				DocCount int    `json:"doc_count"`
-			}{
-				b.Key: b,
-			}
-			bb = append(bb, b)
+	}
+
+	if searchString != "" {
+		searchHits.Observe(float64(results.Hits.Total.Value))
+		if results.Hits.Total.Value == 0 {
+			searchZeroResults.Inc()
 		}
+	}
+
+	if results != nil && aggregation != nil {
+		// module field facets are aggregated with hits
+		aggregation.Aggregations.Facets = results.Aggregations.Facets
+	}
 
-		for _, agg := range namespaceAggs {
-			if _, ok := nsMap[agg]; !ok {
-				nsMap = map[string]struct {
-					Key      string `json:"key"`
-					DocCount int    `json:"doc_count"`
-				}{
-					agg: {Key: agg, DocCount: 0},
-				}
-				bb = append(bb, struct {
-					Key      string `json:"key"`
-					DocCount int    `json:"doc_count"`
-				}{Key: agg, DocCount: 0})
+	if rAggregation != nil {
+		for _, agg := range []*esSearchResponse{results, aggregation} {
+			if agg != nil {
+				agg.Aggregations.Resource = rAggregation.Aggregations.Resource
 			}
 		}
+	}
 
-		if len(bb) > 0 {
-			results.Aggregations.Namespace.Buckets = bb
+	if len(searchString) == 0 {
+		if aggregation != nil && nsAggregation != nil {
+			aggregation.Aggregations.Namespace = nsAggregation.Aggregations.Namespace
 		}
+	} else if results != nil && mAggregation != nil {
+		results.Aggregations.Module = mAggregation.Aggregations.Module
 	}
 
-	mAggregation, err = search(ctx, h.esc, h.log, searchParams{
-		size:          size,
-		dumpRaw:       r.FormValue("dump") != "",
-		query:         searchString,
-		namespaceAggs: namespaceAggs,
-		aggOnly:       true,
-		mAggOnly:      true,
-	})
+	if results != nil {
+		// selected namespaces and modules stay in the facets even without hits
+		results.Aggregations.Namespace.Buckets = withSelected(results.Aggregations.Namespace.Buckets, namespaceAggs)
+		results.Aggregations.Module.Buckets = withSelected(results.Aggregations.Module.Buckets, moduleAggs)
+	}
+
+	noHits := len(searchString) == 0 && len(moduleAggs) == 0 && len(namespaceAggs) == 0
+
+	_, span := startSpan(ctx, "conv")
+	cres, err := conv(results, aggregation, noHits, h.opt.OmitUnconfiguredRecords, moduleMap, nsHandleMap, mHandleMap)
+	endSpan(span, err)
+
 	if err != nil {
-		h.log.Error("could not execute aggregation search", zap.Error(err))
+		h.log.Error("could not convert search results", zap.Error(err))
+		writeError(w, errBackend(err))
+		return
+	}
+
+	if !noHits {
+		cres.Next, cres.Prev = pg.cursors(results.Hits.Hits, results.hasMore)
 	}
-	if len(searchString) > 0 {
-		if results != nil && mAggregation != nil {
-			results.Aggregations.Module = mAggregation.Aggregations.Module
+
+	if meta.modules != nil {
+		// without metadata none of the labels is resolved; that is already reported
+		if unresolved := unresolvedLabels(cres.Aggregations); len(unresolved) > 0 {
+			warnings = append(warnings, cdWarning{
+				Code:    "labels_unresolved",
+				Message: "labels could not be resolved: " + strings.Join(unresolved, ", "),
+			})
 		}
 	}
 
-	// append module agg response which are not in es response
-	if results != nil && len(moduleAggs) > 0 {
-		mMap := make(map[string]struct {
-			Key      string `json:"key"`
-			DocCount int    `json:"doc_count"`
-		})
-		var bb []struct {
-			Key      string `json:"key"`
-			DocCount int    `json:"doc_count"`
+	cres.Warnings = warnings
+
+	if err = json.NewEncoder(w).Encode(cres); err != nil {
+		h.log.Error("could not encode response body", zap.Error(err))
+	}
+}
+
+// withSelected appends empty buckets for selected keys that are not in the aggregation
+func withSelected(bb []esTermsBucket, selected []string) []esTermsBucket {
+	has := make(map[string]bool, len(bb))
+	for _, b := range bb {
+		has[b.Key] = true
+	}
+
+	for _, key := range selected {
+		if !has[key] {
+			has[key] = true
+			bb = append(bb, esTermsBucket{Key: key})
 		}
-		for _, b := range results.Aggregations.Module.Buckets {
-			mMap = map[string]struct {
-				Key      string `json:"key"`
-				DocCount int    `json:"doc_count"`
-			}{
-				b.Key: b,
-			}
-			bb = append(bb, b)
+	}
+
+	return bb
+}
+
+// failedVariants returns variants of the queries without response
+func failedVariants(pp []searchParams, rr []*esSearchResponse) (out []string) {
+	for i := range rr {
+		if rr[i] == nil {
+			out = append(out, pp[i].variant)
 		}
+	}
 
-		for _, agg := range moduleAggs {
-			if _, ok := mMap[agg]; !ok {
-				mMap = map[string]struct {
-					Key      string `json:"key"`
-					DocCount int    `json:"doc_count"`
-				}{
-					agg: {Key: agg, DocCount: 0},
-				}
-				bb = append(bb, struct {
-					Key      string `json:"key"`
-					DocCount int    `json:"doc_count"`
-				}{Key: agg, DocCount: 0})
-			}
+	return
+}
+
+// unresolvedLabels returns namespaces and modules in aggregations without a label
+func unresolvedLabels(aa []cdAggregation) (out []string) {
+	for _, a := range aa {
+		if a.Resource != "compose:namespace" && a.Resource != "compose:module" {
+			continue
 		}
 
-		if len(bb) > 0 {
-			results.Aggregations.Module.Buckets = bb
+		for _, b := range a.ResourceName {
+			if b.Label == "" {
+				out = append(out, a.Name+" "+b.Name)
+			}
 		}
 	}
 
-	noHits := len(searchString) == 0 && len(moduleAggs) == 0 && len(namespaceAggs) == 0
-	//if !noHits {
-	// @todo only fetch module from result but that requires another loop to fetch module Id from es response
-	// 			TEMP fix, I have solution use elastic for the same but different index
-	nsReq, err = h.api.namespaces()
-	if err != nil {
-		h.log.Warn("failed to prepare namespace request: %w", zap.Error(err))
-	} else {
-		if nsRes, err = httpClient().Do(nsReq.WithContext(ctx)); err != nil {
-			h.log.Error("failed to send namespace request: %w", zap.Error(err))
-		}
-		if nsRes.StatusCode != http.StatusOK {
-			fmt.Println("err: ", err)
-			h.log.Error("request resulted in an unexpected status: %s", zap.Error(err))
+	return
+}
+
+// resourceTypes reads and validates resource types filter from the request
+//
+// Types can be given as a repeated or as a comma delimited "types" param
+func resourceTypes(r *http.Request) (tt []string, err error) {
+	for _, v := range r.Form["types"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+
+			if getResourceName(t) == "Resource" {
+				return nil, fmt.Errorf("unknown resource type: %q", t)
+			}
+
+			tt = append(tt, t)
 		}
-		if err = json.NewDecoder(nsRes.Body).Decode(&nsResponse); err != nil {
-			h.log.Error("failed to decode response: %w", zap.Error(err))
+	}
+
+	return
+}
+
+// valuesLimit reads max number of record values from the request
+//
+// Zero means limit from the module's discovery meta (or default) is used
+func valuesLimit(r *http.Request) (l int, err error) {
+	v := r.FormValue("valuesLimit")
+	if v == "" {
+		return 0, nil
+	}
+
+	if l, err = strconv.Atoi(v); err != nil || l < 1 {
+		return 0, fmt.Errorf("invalid valuesLimit: %q", v)
+	}
+
+	if l > maxValuesLimit {
+		l = maxValuesLimit
+	}
+
+	return l, nil
+}
+
+// fieldFilters reads "filter[<field>]=<value>" params from the request
+//
+// Only facet fields of the filtered modules are allowed
+func fieldFilters(r *http.Request, facets []string) (ff map[string][]string, err error) {
+	allowed := make(map[string]bool)
+	for _, f := range facets {
+		allowed[f] = true
+	}
+
+	for k, vv := range r.Form {
+		if !strings.HasPrefix(k, "filter[") || !strings.HasSuffix(k, "]") {
+			continue
 		}
-		if err = nsRes.Body.Close(); err != nil {
-			h.log.Error("failed to close response body: %w", zap.Error(err))
+
+		f := k[len("filter[") : len(k)-1]
+		if !allowed[f] {
+			return nil, fmt.Errorf("filtering by field %q is not allowed", f)
 		}
 
-		for _, s := range nsResponse.Response.Set {
-			// Get the module handles for aggs response
-			nsHandleMap[s.Name] = s.Slug
-			if mReq, err = h.api.modules(s.NamespaceID); err != nil {
-				h.log.Error("failed to prepare module meta request: %w", zap.Error(err))
-			}
-			if mRes, err = httpClient().Do(mReq.WithContext(ctx)); err != nil {
-				h.log.Error("failed to send module request: %w", zap.Error(err))
-			}
-			if mRes.StatusCode != http.StatusOK {
-				h.log.Error("request resulted in an unexpected status: %s", zap.Error(err))
-			}
-			if err = json.NewDecoder(mRes.Body).Decode(&mResponse); err != nil {
-				h.log.Error("failed to decode response: %w", zap.Error(err))
-			}
-			if err = mRes.Body.Close(); err != nil {
-				h.log.Error("failed to close response body: %w", zap.Error(err))
-			}
+		if ff == nil {
+			ff = make(map[string][]string)
+		}
 
-			for _, m := range mResponse.Response.Set {
-				// Get the module handles for aggs response
-				mHandleMap[m.Name] = m.Handle
-				var (
-					meta moduleMeta
-					key  = fmt.Sprintf("%d-%d", s.NamespaceID, m.ModuleID)
-				)
-				err = json.Unmarshal(m.Meta, &meta)
-				if err != nil {
-					h.log.Error("failed to unmarshal module meta: %w", zap.Error(err))
-				} else if len(meta.Discovery.Private.Result) > 0 && len(meta.Discovery.Private.Result[0].Fields) > 0 {
-					moduleMap[key] = meta.Discovery.Private.Result[0].Fields
-				}
+		for _, v := range vv {
+			if v != "" {
+				ff[f] = append(ff[f], v)
 			}
 		}
 	}
-	//}
 
-	if cres, err := conv(results, aggregation, noHits, moduleMap, nsHandleMap, mHandleMap); err != nil {
-		h.log.Error("could not encode response body", zap.Error(err))
-	} else if err = json.NewEncoder(w).Encode(cres); err != nil {
-		h.log.Error("could not encode response body", zap.Error(err))
-	}
+	return
 }
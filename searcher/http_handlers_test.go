@@ -0,0 +1,267 @@
+package searcher
+
+import (
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret = "secret"
+
+	testDocs = `
+{"_index":"corteza-private-compose-record-1","_id":"r1","_source":{"resourceType":"compose:record","namespace":{"name":"CRM","namespaceId":"1"},"module":{"name":"Lead","moduleId":"2"},"values":{"Name":["Alice Smith"],"Status":["open"],"Amount":["10"]},"created":{"at":"2021-01-02T10:00:00Z"},"security":{"allowedRoles":["10"],"deniedRoles":[]}}}
+{"_index":"corteza-private-compose-record-1","_id":"r2","_source":{"resourceType":"compose:record","namespace":{"name":"CRM","namespaceId":"1"},"module":{"name":"Lead","moduleId":"2"},"values":{"Name":["Bob Alison"],"Status":["closed"],"Amount":["30"]},"created":{"at":"2021-03-02T10:00:00Z"},"security":{"allowedRoles":["10"],"deniedRoles":[]}}}
+{"_index":"corteza-private-compose-namespace","_id":"n1","_source":{"resourceType":"compose:namespace","name":"CRM","handle":"crm","security":{"allowedRoles":["10"],"deniedRoles":[]}}}
+{"_index":"corteza-public-compose-namespace","_id":"p1","_source":{"resourceType":"compose:namespace","name":"Public <b>Alpha</b>","handle":"alpha"}}
+`
+
+	testModuleMeta = `{"private": {"result": [{"fields": ["Name", "Status"]}]}, "facets": ["Status", "Amount"]}`
+)
+
+// testServer runs handlers with the embedded backend and cached metadata
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "docs.ndjson")
+	if err := ioutil.WriteFile(path, []byte(testDocs), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := EmbeddedBackend(zap.NewNop(), path, "_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mm ModuleMeta
+	if err = json.Unmarshal([]byte(testModuleMeta), &mm); err != nil {
+		t.Fatal(err)
+	}
+
+	api, _ := ApiClient(ApiOptions{})
+	meta := MetadataCache(zap.NewNop(), api, time.Hour)
+	meta.meta = &metadata{
+		modules:    map[string]ModuleMeta{"1-2": mm},
+		nsHandles:  map[string]string{"CRM": "crm"},
+		mHandles:   map[string]string{"Lead": "lead"},
+		moduleKeys: map[string][]string{"Lead": {"1-2"}},
+		fields:     map[string][]string{"1-2": {"Amount", "Status", "Name"}},
+	}
+	meta.fetchedAt = time.Now()
+
+	jwtv, err := JwtVerifier(zap.NewNop(), JwtOptions{Secret: []byte(testSecret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(jwtv.Verifier)
+	Handlers(r, zap.NewNop(), backend, api, meta, Options{})
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get sends request (with an access token when set) and decodes JSON response
+func get(t *testing.T, srv *httptest.Server, uri, token string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+uri, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rsp.Body.Close()
+
+	out := make(map[string]interface{})
+	if err = json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+		t.Fatalf("could not decode response of %s: %v", uri, err)
+	}
+
+	return rsp.StatusCode, out
+}
+
+func testToken(t *testing.T) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"sub": "5", "roles": "10"}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestSearch(t *testing.T) {
+	var (
+		srv   = testServer(t)
+		token = testToken(t)
+	)
+
+	t.Run("public tier", func(t *testing.T) {
+		status, rsp := get(t, srv, "/?q=alpha", "")
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", status, rsp)
+		}
+
+		hits, _ := rsp["hits"].([]interface{})
+		if len(hits) != 1 {
+			t.Fatalf("expected 1 public hit, got %d", len(hits))
+		}
+
+		hl, _ := json.Marshal(hits[0].(map[string]interface{})["highlight"])
+		if strings.Contains(string(hl), "<b>") {
+			t.Errorf("expected escaped highlight, got %s", hl)
+		}
+	})
+
+	t.Run("private values are whitelisted", func(t *testing.T) {
+		status, rsp := get(t, srv, "/?q=alice", token)
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", status, rsp)
+		}
+
+		raw, _ := json.Marshal(rsp["hits"])
+		if !strings.Contains(string(raw), "Alice Smith") {
+			t.Errorf("expected record in hits, got %s", raw)
+		}
+
+		if strings.Contains(string(raw), "Amount") {
+			t.Errorf("expected values of not configured fields to be omitted, got %s", raw)
+		}
+	})
+
+	t.Run("facets are whitelisted", func(t *testing.T) {
+		status, rsp := get(t, srv, "/?moduleAggs=Lead", token)
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", status, rsp)
+		}
+
+		var fields []string
+		for _, a := range rsp["aggregations"].([]interface{}) {
+			if a := a.(map[string]interface{}); a["resource"] == "field" {
+				fields = append(fields, a["name"].(string))
+			}
+		}
+
+		if len(fields) != 1 || !strings.HasSuffix(fields[0], "Status") {
+			t.Errorf("expected Status facet only, got %v", fields)
+		}
+
+		if status, rsp = get(t, srv, "/?moduleAggs=Lead&filter[Amount]=10", token); status != http.StatusBadRequest {
+			t.Errorf("expected 400 when filtering by hidden field, got %d: %v", status, rsp)
+		}
+	})
+
+	t.Run("page out of range", func(t *testing.T) {
+		status, rsp := get(t, srv, "/?q=alpha&page=100&perPage=100", "")
+		if status != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d: %v", status, rsp)
+		}
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	var (
+		srv   = testServer(t)
+		token = testToken(t)
+	)
+
+	cases := []struct {
+		name   string
+		uri    string
+		token  string
+		status int
+	}{
+		{"configured field", "/aggregate?type=composite&field=values.Name.keyword", token, http.StatusOK},
+		{"metadata field", "/aggregate?type=cardinality&field=resourceType", "", http.StatusOK},
+		{"field not in result configuration", "/aggregate?type=composite&field=values.Amount.keyword", token, http.StatusBadRequest},
+		{"field not visible in public tier", "/aggregate?type=composite&field=values.Name.keyword", "", http.StatusBadRequest},
+		{"security field", "/aggregate?type=composite&field=security.allowedRoles", token, http.StatusBadRequest},
+		{"date histogram", "/aggregate?type=dateHistogram&interval=day&field=created.at", token, http.StatusOK},
+		{"too many buckets", "/aggregate?type=dateHistogram&interval=second&field=created.at", token, http.StatusBadRequest},
+		{"too many auto buckets", "/aggregate?type=dateHistogram&buckets=100000&field=created.at", token, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if status, rsp := get(t, srv, c.uri, c.token); status != c.status {
+				t.Errorf("expected %d, got %d: %v", c.status, status, rsp)
+			}
+		})
+	}
+
+	t.Run("range without values", func(t *testing.T) {
+		status, rsp := get(t, srv, "/aggregate?type=range&field=created.at&q=nothing", token)
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %v", status, rsp)
+		}
+
+		if _, has := rsp["min"]; has {
+			t.Errorf("expected min and max to be omitted, got %v", rsp)
+		}
+	})
+
+	t.Run("metadata text field", func(t *testing.T) {
+		if _, rsp := get(t, srv, "/aggregate?type=cardinality&field=namespace.name", ""); rsp["field"] != "namespace.name.keyword" {
+			t.Errorf("expected aggregation over keyword subfield, got %v", rsp)
+		}
+	})
+}
+
+func TestSuggest(t *testing.T) {
+	var (
+		srv   = testServer(t)
+		token = testToken(t)
+	)
+
+	cases := []struct {
+		name   string
+		uri    string
+		status int
+		values []string
+	}{
+		{"visible value", "/suggest?q=ope", http.StatusOK, []string{"open"}},
+		{"hidden value", "/suggest?q=30", http.StatusOK, []string{}},
+		{"namespace name", "/suggest?q=cr", http.StatusOK, []string{"CRM"}},
+		{"invalid limit", "/suggest?q=ope&limit=x", http.StatusBadRequest, nil},
+		{"negative limit", "/suggest?q=ope&limit=-1", http.StatusBadRequest, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status, rsp := get(t, srv, c.uri, token)
+			if status != c.status {
+				t.Fatalf("expected %d, got %d: %v", c.status, status, rsp)
+			}
+
+			if c.values == nil {
+				return
+			}
+
+			values := []string{}
+			for _, s := range rsp["suggestions"].([]interface{}) {
+				values = append(values, s.(map[string]interface{})["value"].(string))
+			}
+
+			if !reflect.DeepEqual(values, c.values) {
+				t.Errorf("expected %v, got %v", c.values, values)
+			}
+		})
+	}
+}
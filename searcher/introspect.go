@@ -0,0 +1,145 @@
+package searcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/go-chi/jwtauth"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// tokenIntrospector rejects tokens that were revoked on the Corteza auth server
+	// (user logged out, was suspended...) before they expire
+	tokenIntrospector struct {
+		log *zap.Logger
+		api *apiClient
+		ttl time.Duration
+
+		mux   sync.Mutex
+		cache map[[sha256.Size]byte]introspection
+
+		// deduplicates concurrent checks of the same token
+		group singleflight.Group
+	}
+
+	introspection struct {
+		active    bool
+		expiresAt time.Time
+	}
+)
+
+const (
+	introspectTimeout = 5 * time.Second
+
+	// expired results are swept when cache grows beyond this
+	introspectCacheSize = 10000
+)
+
+var (
+	errTokenRevoked = errors.New("token revoked")
+)
+
+func TokenIntrospector(log *zap.Logger, api *apiClient, ttl time.Duration) *tokenIntrospector {
+	return &tokenIntrospector{
+		log:   log.Named("introspection"),
+		api:   api,
+		ttl:   ttl,
+		cache: make(map[[sha256.Size]byte]introspection),
+	}
+}
+
+// Introspect checks verified token from the context
+//
+// Revoked tokens are removed from the context and the request continues as anonymous.
+// When token state can not be determined (auth server is down), request is rejected
+// with 503; it is not known if the token was revoked.
+func (i *tokenIntrospector) Introspect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		token, _, err := jwtauth.FromContext(ctx)
+		if err != nil || token == nil || !token.Valid {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		active, err := i.active(ctx, token.Raw)
+		if err != nil {
+			i.log.Warn("token introspection failed", zap.Error(err))
+			writeError(w, errUnavailable("introspection_unavailable", "access token could not be checked with the auth server"))
+			return
+		}
+
+		if !active {
+			ctx = jwtauth.NewContext(ctx, nil, errTokenRevoked)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// active returns cached introspection result or asks the auth server
+//
+// Concurrent checks of the same token share the request of the first caller;
+// each caller waits only until its own context is done.
+func (i *tokenIntrospector) active(ctx context.Context, token string) (bool, error) {
+	key := sha256.Sum256([]byte(token))
+
+	i.mux.Lock()
+	res, ok := i.cache[key]
+	i.mux.Unlock()
+
+	if ok && time.Now().Before(res.expiresAt) {
+		return res.active, nil
+	}
+
+	ch := i.group.DoChan(string(key[:]), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, introspectTimeout)
+		defer cancel()
+
+		active, err := i.api.introspect(ctx, token)
+		if err != nil {
+			// failures are not cached
+			return false, err
+		}
+
+		i.store(key, active)
+		return active, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return false, res.Err
+		}
+
+		return res.Val.(bool), nil
+	}
+}
+
+func (i *tokenIntrospector) store(key [sha256.Size]byte, active bool) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	now := time.Now()
+	if len(i.cache) >= introspectCacheSize {
+		for k, res := range i.cache {
+			if now.After(res.expiresAt) {
+				delete(i.cache, k)
+			}
+		}
+
+		if len(i.cache) >= introspectCacheSize {
+			i.cache = make(map[[sha256.Size]byte]introspection)
+		}
+	}
+
+	i.cache[key] = introspection{active: active, expiresAt: now.Add(i.ttl)}
+}
@@ -0,0 +1,107 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIntrospect(t *testing.T) {
+	var (
+		token = testToken(t)
+		state string
+	)
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// closed connection is noticed only after the body is read
+		_ = r.ParseForm()
+
+		switch state {
+		case "down":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "slow":
+			<-r.Context().Done()
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]bool{"active": state == "active"})
+		}
+	}))
+	defer auth.Close()
+
+	api, _ := ApiClient(ApiOptions{AuthURL: auth.URL})
+
+	jwtv, err := JwtVerifier(zap.NewNop(), JwtOptions{Secret: []byte(testSecret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(jwtv.Verifier)
+	r.Use(TokenIntrospector(zap.NewNop(), api, 0).Introspect)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := identity(r.Context())
+		_ = json.NewEncoder(w).Encode(map[string]uint64{"userID": userID})
+	})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	cases := []struct {
+		state  string
+		status int
+		rsp    map[string]interface{}
+	}{
+		{"active", http.StatusOK, map[string]interface{}{"userID": 5.0}},
+		{"revoked", http.StatusOK, map[string]interface{}{"userID": 0.0}},
+		{"down", http.StatusServiceUnavailable, map[string]interface{}{"error": map[string]interface{}{
+			"code":    "introspection_unavailable",
+			"message": "access token could not be checked with the auth server",
+		}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.state, func(t *testing.T) {
+			state = c.state
+
+			status, rsp := get(t, srv, "/", token)
+			if status != c.status {
+				t.Fatalf("expected %d, got %d: %v", c.status, status, rsp)
+			}
+
+			if enc, exp := mustJSON(t, rsp), mustJSON(t, c.rsp); enc != exp {
+				t.Errorf("expected %s, got %s", exp, enc)
+			}
+		})
+	}
+
+	t.Run("request context", func(t *testing.T) {
+		state = "slow"
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if _, err := TokenIntrospector(zap.NewNop(), api, 0).active(ctx, token); err == nil {
+			t.Error("expected error")
+		}
+
+		if time.Since(start) > introspectTimeout/2 {
+			t.Errorf("expected introspection to end with the request context")
+		}
+	})
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	enc, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(enc)
+}
@@ -0,0 +1,464 @@
+package searcher
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/jwtauth"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// JwtOptions configure verification of access tokens
+	JwtOptions struct {
+		// shared secret for HMAC signed tokens
+		Secret []byte
+
+		// JWKS endpoint with public keys
+		JwksURL string
+
+		// how often keys are re-fetched from the JWKS endpoint
+		JwksRefresh time.Duration
+
+		// PEM files with public keys or certificates
+		PublicKeyFiles []string
+
+		// when set, token must be issued by the issuer
+		// and for at least one of the audiences
+		Issuer   string
+		Audience []string
+	}
+
+	jwtVerifier struct {
+		log    *zap.Logger
+		opt    JwtOptions
+		client *http.Client
+
+		// keys from the files (never change)
+		static []jwtKey
+
+		mux       sync.RWMutex
+		jwks      []jwtKey
+		fetchedAt time.Time
+
+		// deduplicates concurrent fetches
+		group singleflight.Group
+	}
+
+	jwtKey struct {
+		// key ID; empty for keys from the files
+		kid string
+		key interface{}
+	}
+
+	jwkSet struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+
+			// RSA
+			N string `json:"n"`
+			E string `json:"e"`
+
+			// EC
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+
+	// unknown key ID triggers re-fetch of the JWKS but not more often than this
+	jwksMinRefresh = 30 * time.Second
+)
+
+var (
+	hmacMethods       = []string{"HS256", "HS384", "HS512"}
+	asymmetricMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+func JwtVerifier(log *zap.Logger, opt JwtOptions) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		log:    log.Named("jwt"),
+		opt:    opt,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+
+	for _, path := range opt.PublicKeyFiles {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		v.static = append(v.static, jwtKey{key: key})
+	}
+
+	return v, nil
+}
+
+// Enabled returns true if there is any key to verify tokens with
+func (v *jwtVerifier) Enabled() bool {
+	return len(v.opt.Secret) > 0 || len(v.static) > 0 || v.opt.JwksURL != ""
+}
+
+// Watch fetches keys from the JWKS endpoint and keeps them fresh
+//
+// Function blocks until context is done
+func (v *jwtVerifier) Watch(ctx context.Context) {
+	if v.opt.JwksURL == "" {
+		return
+	}
+
+	if err := v.refresh(); err != nil {
+		v.log.Error("failed to fetch JWKS", zap.Error(err))
+	}
+
+	if v.opt.JwksRefresh <= 0 {
+		return
+	}
+
+	t := time.NewTicker(v.opt.JwksRefresh)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := v.refresh(); err != nil {
+				v.log.Warn("JWKS refresh failed, using previous keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Verifier verifies token from the request and stores it in the context
+//
+// Only valid tokens are stored; requests with invalid
+// or without tokens are passed on as anonymous
+func (v *jwtVerifier) Verifier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ctx = r.Context()
+			err = jwtauth.ErrNoTokenFound
+
+			token *jwt.Token
+		)
+
+		for _, fn := range []func(*http.Request) string{jwtauth.TokenFromQuery, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie} {
+			if raw := fn(r); raw != "" {
+				if token, err = v.verify(raw); err != nil {
+					v.log.Debug("invalid token", zap.Error(err))
+					token = nil
+
+					var verr *jwt.ValidationError
+					if errors.As(err, &verr) && verr.Errors&jwt.ValidationErrorExpired > 0 {
+						err = jwtauth.ErrExpired
+					}
+				}
+
+				break
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(ctx, token, err)))
+	})
+}
+
+// verify parses the token and checks signature, time based claims,
+// issuer and audience
+func (v *jwtVerifier) verify(raw string) (*jwt.Token, error) {
+	var (
+		parser = &jwt.Parser{}
+		kid    string
+		alg    string
+	)
+
+	unverified, _, err := parser.ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _ = unverified.Header["kid"].(string)
+	alg = unverified.Method.Alg()
+
+	var keys []interface{}
+	switch {
+	case inStrings(alg, hmacMethods):
+		if len(v.opt.Secret) > 0 {
+			keys = append(keys, v.opt.Secret)
+		}
+		parser.ValidMethods = hmacMethods
+
+	case inStrings(alg, asymmetricMethods):
+		keys = v.keys(kid)
+		parser.ValidMethods = asymmetricMethods
+
+	default:
+		return nil, fmt.Errorf("unsupported signing method: %s", alg)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key to verify %s token (kid: %q)", alg, kid)
+	}
+
+	// there can be more than one candidate (keys without ID), first one that verifies wins
+	for _, key := range keys {
+		var token *jwt.Token
+		token, err = parser.Parse(raw, func(*jwt.Token) (interface{}, error) { return key, nil })
+		if err != nil {
+			continue
+		}
+
+		return token, v.verifyClaims(token.Claims.(jwt.MapClaims))
+	}
+
+	return nil, err
+}
+
+func (v *jwtVerifier) verifyClaims(claims jwt.MapClaims) error {
+	if v.opt.Issuer != "" && !claims.VerifyIssuer(v.opt.Issuer, true) {
+		return fmt.Errorf("invalid issuer")
+	}
+
+	if len(v.opt.Audience) == 0 {
+		return nil
+	}
+
+	var aud []string
+	switch a := claims["aud"].(type) {
+	case string:
+		aud = []string{a}
+	case []interface{}:
+		for _, s := range a {
+			if s, is := s.(string); is {
+				aud = append(aud, s)
+			}
+		}
+	}
+
+	for _, a := range aud {
+		if inStrings(a, v.opt.Audience) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid audience")
+}
+
+// keys returns candidate public keys for the key ID
+//
+// Unknown key ID usually means keys were rotated;
+// JWKS is re-fetched to pick up the new key.
+func (v *jwtVerifier) keys(kid string) []interface{} {
+	v.mux.RLock()
+	out := matchingKeys(kid, v.static, v.jwks)
+	known := hasKey(kid, v.jwks)
+	stale := time.Since(v.fetchedAt) > jwksMinRefresh
+	v.mux.RUnlock()
+
+	// static keys have no ID and match any; they must not prevent the refresh
+	if known || kid == "" || v.opt.JwksURL == "" || !stale {
+		return out
+	}
+
+	if err := v.refresh(); err != nil {
+		v.log.Warn("JWKS refresh failed", zap.Error(err))
+		return out
+	}
+
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	return matchingKeys(kid, v.static, v.jwks)
+}
+
+// refresh replaces keys with the ones from the JWKS endpoint
+//
+// Concurrent calls are deduplicated and share the result
+func (v *jwtVerifier) refresh() error {
+	_, err, _ := v.group.Do("jwks", func() (interface{}, error) {
+		return nil, v.fetch()
+	})
+
+	return err
+}
+
+func (v *jwtVerifier) fetch() error {
+	req, err := http.NewRequest(http.MethodGet, v.opt.JwksURL, nil)
+	if err != nil {
+		return err
+	}
+
+	// mark the attempt so failing endpoint is not hammered on unknown key IDs
+	v.mux.Lock()
+	v.fetchedAt = time.Now()
+	v.mux.Unlock()
+
+	rsp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected JWKS response status: %s", rsp.Status)
+	}
+
+	var set jwkSet
+	if err = json.NewDecoder(rsp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("could not decode JWKS: %w", err)
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaPublicKey(k.N, k.E)
+		case "EC":
+			key, err = ecPublicKey(k.Crv, k.X, k.Y)
+		default:
+			continue
+		}
+
+		if err != nil {
+			v.log.Warn("skipping invalid JWK", zap.String("kid", k.Kid), zap.Error(err))
+			continue
+		}
+
+		keys = append(keys, jwtKey{kid: k.Kid, key: key})
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable keys in JWKS")
+	}
+
+	v.mux.Lock()
+	v.jwks = keys
+	v.mux.Unlock()
+
+	v.log.Debug("JWKS refreshed", zap.Int("keys", len(keys)))
+	return nil
+}
+
+// matchingKeys returns keys with the given ID and keys without one
+func matchingKeys(kid string, sets ...[]jwtKey) (out []interface{}) {
+	for _, set := range sets {
+		for _, k := range set {
+			if k.kid == "" || kid == "" || k.kid == kid {
+				out = append(out, k.key)
+			}
+		}
+	}
+
+	return
+}
+
+// hasKey checks if there is a key with the given ID in the set
+func hasKey(kid string, set []jwtKey) bool {
+	for _, k := range set {
+		if k.kid == kid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func loadPublicKey(path string) (interface{}, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key: %w", err)
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+
+	if key, err := jwt.ParseECPublicKeyFromPEM(pem); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no RSA or EC public key found in %s", path)
+}
+
+func rsaPublicKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func ecPublicKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %q", crv)
+	}
+
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %w", err)
+	}
+
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %w", err)
+	}
+
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on the curve")
+	}
+
+	return key, nil
+}
+
+func inStrings(s string, ss []string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,206 @@
+package searcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJwtVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JWKS with the RSA key
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "rsa1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	// PEM file with the EC public key
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	ecPath := filepath.Join(t.TempDir(), "ec.pem")
+	if err = ioutil.WriteFile(ecPath, ecPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(mod func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "5",
+			"iss": "corteza",
+			"aud": "discovery",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+
+		if mod != nil {
+			mod(c)
+		}
+
+		return c
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, c jwt.MapClaims, key interface{}) string {
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return raw
+	}
+
+	var (
+		secret    = []byte("secret")
+		asymOnly  = JwtOptions{JwksURL: jwks.URL, PublicKeyFiles: []string{ecPath}, Issuer: "corteza", Audience: []string{"discovery"}}
+		withHmac  = JwtOptions{Secret: secret, JwksURL: jwks.URL, Issuer: "corteza", Audience: []string{"other", "discovery"}}
+		noIssuer  = func(c jwt.MapClaims) { delete(c, "iss") }
+		audList   = func(c jwt.MapClaims) { c["aud"] = []interface{}{"x", "discovery"} }
+		otherIss  = func(c jwt.MapClaims) { c["iss"] = "someone-else" }
+		otherAud  = func(c jwt.MapClaims) { c["aud"] = "someone-else" }
+		expired   = func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }
+		otherRsa  *rsa.PrivateKey
+		unsignedT string
+	)
+
+	if otherRsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+
+	if unsignedT, err = jwt.NewWithClaims(jwt.SigningMethodNone, claims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		opt   JwtOptions
+		token string
+		valid bool
+	}{
+		{"RS256 from JWKS", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(nil), rsaKey), true},
+		{"ES256 from file", asymOnly, sign(jwt.SigningMethodES256, "", claims(nil), ecKey), true},
+		{"HS512 with secret", withHmac, sign(jwt.SigningMethodHS512, "", claims(nil), secret), true},
+		{"audience list", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(audList), rsaKey), true},
+
+		{"none algorithm", asymOnly, unsignedT, false},
+		{"none algorithm with secret", withHmac, unsignedT, false},
+		{"HS256 without secret", asymOnly, sign(jwt.SigningMethodHS256, "", claims(nil), secret), false},
+		{"HS256 signed with public key", asymOnly, sign(jwt.SigningMethodHS256, "", claims(nil), ecPem), false},
+		{"HS256 with wrong secret", withHmac, sign(jwt.SigningMethodHS256, "", claims(nil), []byte("wrong")), false},
+		{"unknown kid", asymOnly, sign(jwt.SigningMethodRS256, "rsa2", claims(nil), otherRsa), false},
+		{"known kid, wrong key", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(nil), otherRsa), false},
+		{"missing issuer", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(noIssuer), rsaKey), false},
+		{"issuer mismatch", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(otherIss), rsaKey), false},
+		{"audience mismatch", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(otherAud), rsaKey), false},
+		{"audience mismatch with secret", withHmac, sign(jwt.SigningMethodHS512, "", claims(otherAud), secret), false},
+		{"expired", asymOnly, sign(jwt.SigningMethodRS256, "rsa1", claims(expired), rsaKey), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := JwtVerifier(zap.NewNop(), c.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = v.verify(c.token); (err == nil) != c.valid {
+				t.Errorf("expected valid=%v, got error: %v", c.valid, err)
+			}
+		})
+	}
+}
+
+func TestRsaPublicKey(t *testing.T) {
+	enc := func(i int64) string {
+		return base64.RawURLEncoding.EncodeToString(big.NewInt(i).Bytes())
+	}
+
+	cases := []struct {
+		name  string
+		n, e  string
+		valid bool
+	}{
+		{"valid", enc(1 << 40), enc(65537), true},
+		{"invalid encoding", "!", enc(65537), false},
+		{"exponent too small", enc(1 << 40), enc(1), false},
+		{"exponent too large", enc(1 << 40), base64.RawURLEncoding.EncodeToString(new(big.Int).Lsh(big.NewInt(1), 40).Bytes()), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := rsaPublicKey(c.n, c.e); (err == nil) != c.valid {
+				t.Errorf("expected valid=%v, got error: %v", c.valid, err)
+			}
+		})
+	}
+}
+
+func TestEcPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		x = base64.RawURLEncoding.EncodeToString(key.X.Bytes())
+		y = base64.RawURLEncoding.EncodeToString(key.Y.Bytes())
+
+		// point that is not on the curve
+		offY = base64.RawURLEncoding.EncodeToString(new(big.Int).Add(key.Y, big.NewInt(1)).Bytes())
+	)
+
+	cases := []struct {
+		name      string
+		crv, x, y string
+		valid     bool
+	}{
+		{"valid", "P-256", x, y, true},
+		{"unsupported curve", "P-192", x, y, false},
+		{"wrong curve", "P-384", x, y, false},
+		{"point not on the curve", "P-256", x, offY, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ecPublicKey(c.crv, c.x, c.y); (err == nil) != c.valid {
+				t.Errorf("expected valid=%v, got error: %v", c.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// metadata holds namespace and module information from Corteza
+	// needed to label aggregations and to convert hits
+	metadata struct {
+		// module discovery meta, indexed by "<namespaceID>-<moduleID>"
+		modules map[string]ModuleMeta
+
+		// namespace name => slug
+		nsHandles map[string]string
+
+		// module name => handle
+		mHandles map[string]string
+
+		// module name => keys of the modules with that name
+		moduleKeys map[string][]string
+
+		// module field names in the definition order,
+		// indexed by "<namespaceID>-<moduleID>"
+		fields map[string][]string
+	}
+
+	metaCache struct {
+		log *zap.Logger
+		api *apiClient
+		ttl time.Duration
+
+		mux       sync.RWMutex
+		meta      *metadata
+		fetchedAt time.Time
+
+		// deduplicates concurrent fetches
+		group singleflight.Group
+	}
+)
+
+const (
+	metaFetchTimeout = time.Minute
+
+	// number of values returned per record when
+	// not set by the request or module's discovery meta
+	defaultValuesLimit = 5
+	maxValuesLimit     = 100
+)
+
+func MetadataCache(log *zap.Logger, api *apiClient, ttl time.Duration) *metaCache {
+	return &metaCache{
+		log: log.Named("metadata"),
+		api: api,
+		ttl: ttl,
+	}
+}
+
+// Watch refreshes metadata in the background before it expires
+//
+// Function blocks until context is done
+func (c *metaCache) Watch(ctx context.Context) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	t := time.NewTicker(c.ttl / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := c.refresh(); err != nil {
+				c.log.Warn("background refresh failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// get returns cached metadata and fetches it when expired
+//
+// When fetch fails and there is stale metadata in the cache,
+// stale metadata is returned
+func (c *metaCache) get() (*metadata, error) {
+	c.mux.RLock()
+	m, fetchedAt := c.meta, c.fetchedAt
+	c.mux.RUnlock()
+
+	if m != nil && time.Since(fetchedAt) < c.ttl {
+		return m, nil
+	}
+
+	fresh, err := c.refresh()
+	if err != nil {
+		if m != nil {
+			c.log.Warn("using stale metadata", zap.Error(err))
+			return m, nil
+		}
+
+		return nil, err
+	}
+
+	return fresh, nil
+}
+
+// invalidate marks cached metadata as expired
+//
+// Cached metadata is still used as a fallback in case refresh fails
+func (c *metaCache) invalidate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.fetchedAt = time.Time{}
+}
+
+// refresh fetches metadata from Corteza and stores it in the cache
+//
+// Concurrent calls are deduplicated and share the result
+func (c *metaCache) refresh() (*metadata, error) {
+	v, err, _ := c.group.Do("metadata", func() (interface{}, error) {
+		// Not using request context; fetch is shared between requests
+		// and should not be canceled when one of them is
+		ctx, cancel := context.WithTimeout(context.Background(), metaFetchTimeout)
+		defer cancel()
+
+		ctx, span := startSpan(ctx, "metadata.fetch")
+		m, err := c.fetch(ctx)
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mux.Lock()
+		c.meta, c.fetchedAt = m, time.Now()
+		c.mux.Unlock()
+
+		c.log.Debug("metadata refreshed",
+			zap.Int("namespaces", len(m.nsHandles)),
+			zap.Int("modules", len(m.mHandles)),
+		)
+
+		return m, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*metadata), nil
+}
+
+// fetch loads all namespaces and their modules from Corteza
+func (c *metaCache) fetch(ctx context.Context) (m *metadata, err error) {
+	var (
+		nsResponse cResponse
+	)
+
+	m = &metadata{
+		modules:    make(map[string]ModuleMeta),
+		nsHandles:  make(map[string]string),
+		mHandles:   make(map[string]string),
+		moduleKeys: make(map[string][]string),
+		fields:     make(map[string][]string),
+	}
+
+	if err = c.api.fetch(ctx, "namespaces", c.api.namespaces(), &nsResponse); err != nil {
+		return nil, fmt.Errorf("failed to fetch namespaces: %w", err)
+	}
+
+	for _, ns := range nsResponse.Response.Set {
+		// Get the namespace handles for aggs response
+		m.nsHandles[ns.Name] = ns.Slug
+
+		var (
+			mResponse   cResponse
+			namespaceID = ns.NamespaceID
+		)
+
+		err = c.api.fetch(ctx, "modules", c.api.modules(namespaceID), &mResponse)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch modules for namespace %d: %w", namespaceID, err)
+		}
+
+		for _, mod := range mResponse.Response.Set {
+			// Get the module handles for aggs response
+			m.mHandles[mod.Name] = mod.Handle
+
+			var meta moduleMeta
+			if err = json.Unmarshal(mod.Meta, &meta); err != nil {
+				c.log.Error("failed to unmarshal module meta",
+					zap.Uint64("moduleID", mod.ModuleID),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			key := fmt.Sprintf("%d-%d", ns.NamespaceID, mod.ModuleID)
+			for _, f := range mod.Fields {
+				m.fields[key] = append(m.fields[key], f.Name)
+			}
+
+			m.modules[key] = meta.Discovery
+			m.moduleKeys[mod.Name] = append(m.moduleKeys[mod.Name], key)
+		}
+	}
+
+	return m, nil
+}
+
+// visibleFields returns fields of modules that have result
+// configuration for the given access tier
+//
+// Fields with role requirement are included only when
+// at least one of the user's roles satisfies it.
+func (m *metadata) visibleFields(t accessTier, roles []string) map[string][]string {
+	out := make(map[string][]string)
+	for key, meta := range m.modules {
+		rr := meta.results(t)
+		if len(rr) == 0 || len(rr[0].Fields) == 0 {
+			continue
+		}
+
+		ff := make([]string, 0, len(rr[0].Fields))
+		for _, f := range rr[0].Fields {
+			if hasAnyRole(roles, rr[0].Roles[f]) {
+				ff = append(ff, f)
+			}
+		}
+
+		out[key] = ff
+	}
+
+	return out
+}
+
+// resultFields returns visible fields of modules
+//
+// Fields are ordered as defined on the module and capped to
+// limit, module's discovery meta limit or defaultValuesLimit.
+func (m *metadata) resultFields(t accessTier, roles []string, limit int) map[string][]string {
+	out := m.visibleFields(t, roles)
+	for key, ff := range out {
+		m.sortFields(key, ff)
+
+		l := limit
+		if l == 0 {
+			l = m.modules[key].results(t)[0].Limit
+		}
+
+		if l <= 0 {
+			l = defaultValuesLimit
+		}
+
+		if len(ff) > l {
+			out[key] = ff[:l]
+		}
+	}
+
+	return out
+}
+
+// modulesWithField returns IDs of the modules with the record field
+// in the result configuration for the given access tier and roles
+func (m *metadata) modulesWithField(t accessTier, roles []string, field string) (out []string) {
+	for key, ff := range m.visibleFields(t, roles) {
+		for _, f := range ff {
+			if f == field {
+				out = append(out, key[strings.Index(key, "-")+1:])
+				break
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return
+}
+
+// sortFields orders fields as they are defined on the module
+//
+// Fields unknown to the module are moved to the end
+func (m *metadata) sortFields(key string, ff []string) {
+	pos := make(map[string]int, len(m.fields[key]))
+	for i, f := range m.fields[key] {
+		pos[f] = i
+	}
+
+	at := func(f string) int {
+		if i, ok := pos[f]; ok {
+			return i
+		}
+
+		return len(pos)
+	}
+
+	sort.SliceStable(ff, func(i, j int) bool {
+		return at(ff[i]) < at(ff[j])
+	})
+}
+
+// facetFields returns sorted, unique facet fields of the modules
+//
+// Facet is included only when it is visible (see visibleFields) in all
+// modules with the given names; facet values are aggregated over all
+// of them and must not reveal values of fields that are not returned.
+func (m *metadata) facetFields(t accessTier, roles []string, moduleNames []string) (out []string) {
+	var (
+		visible = m.visibleFields(t, roles)
+		counts  = make(map[string]int)
+		keys    int
+	)
+
+	for _, name := range moduleNames {
+		for _, key := range m.moduleKeys[name] {
+			keys++
+
+			for _, f := range uniqueStrings(m.modules[key].Facets) {
+				if inStrings(f, visible[key]) {
+					counts[f]++
+				}
+			}
+		}
+	}
+
+	for f, n := range counts {
+		if n == keys {
+			out = append(out, f)
+		}
+	}
+
+	sort.Strings(out)
+	return
+}
+
+func uniqueStrings(ss []string) (out []string) {
+	seen := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,66 @@
+package searcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResultFields(t *testing.T) {
+	metaFor := func(raw string) *metadata {
+		var mm ModuleMeta
+		if err := json.Unmarshal([]byte(raw), &mm); err != nil {
+			t.Fatal(err)
+		}
+
+		return &metadata{
+			modules: map[string]ModuleMeta{"1-2": mm},
+			fields:  map[string][]string{"1-2": {"A", "B", "C", "D", "E", "F", "G"}},
+		}
+	}
+
+	cases := []struct {
+		name   string
+		meta   string
+		roles  []string
+		limit  int
+		fields []string
+	}{
+		{
+			name:   "module order and default limit",
+			meta:   `{"private": {"result": [{"fields": ["G", "F", "E", "D", "C", "B", "A"]}]}}`,
+			fields: []string{"A", "B", "C", "D", "E"},
+		},
+		{
+			name:   "fields unknown to the module are last",
+			meta:   `{"private": {"result": [{"fields": ["X", "G", "A"]}]}}`,
+			fields: []string{"A", "G", "X"},
+		},
+		{
+			name:   "module limit",
+			meta:   `{"private": {"result": [{"fields": ["G", "F", "E", "D", "C", "B", "A"], "limit": 6}]}}`,
+			fields: []string{"A", "B", "C", "D", "E", "F"},
+		},
+		{
+			name:   "request limit overrides module limit",
+			meta:   `{"private": {"result": [{"fields": ["G", "A", "C"], "limit": 2}]}}`,
+			limit:  1,
+			fields: []string{"A"},
+		},
+		{
+			name:   "fields with role requirement",
+			meta:   `{"private": {"result": [{"fields": ["A", "B"], "roles": {"B": ["20"]}}]}}`,
+			roles:  []string{"10"},
+			fields: []string{"A"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out := metaFor(c.meta).resultFields(tierPrivate, c.roles, c.limit)
+			if !reflect.DeepEqual(out["1-2"], c.fields) {
+				t.Errorf("expected %v, got %v", c.fields, out["1-2"])
+			}
+		})
+	}
+}
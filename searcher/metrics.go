@@ -0,0 +1,138 @@
+package searcher
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsNamespace = "discovery_searcher"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	backendQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_query_duration_seconds",
+		Help:      "Search backend request latency (as seen by the searcher) by query variant.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"variant"})
+
+	backendQueryTook = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_query_took_seconds",
+		Help:      "Query execution time reported by the search backend by query variant.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"variant"})
+
+	backendQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_query_errors_total",
+		Help:      "Number of failed search backend queries by query variant.",
+	}, []string{"variant"})
+
+	backendUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_up",
+		Help:      "Search backend health as of the last healthcheck (1 = healthy).",
+	})
+
+	cortezaRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "corteza_request_duration_seconds",
+		Help:      "Corteza API request latency by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	cortezaRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "corteza_request_errors_total",
+		Help:      "Number of failed Corteza API requests by endpoint.",
+	}, []string{"endpoint"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of Corteza API access token refreshes by result.",
+	}, []string{"result"})
+
+	searchHits = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_hits",
+		Help:      "Distribution of total hits per search.",
+		Buckets:   []float64{0, 1, 5, 10, 50, 100, 500, 1000, 10000},
+	})
+
+	searchZeroResults = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_zero_results_total",
+		Help:      "Number of searches (with search string) without any hits.",
+	})
+)
+
+// instrument records count and latency of the requests
+//
+// Route pattern is used instead of the path to keep cardinality low
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			ww    = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeBackend records latency of the backend request
+// and counts failures
+func observeBackend(variant string, start time.Time, err error) {
+	backendQueryDuration.WithLabelValues(variant).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendQueryErrors.WithLabelValues(variant).Inc()
+	}
+}
+
+// observeTook records query execution time reported by the backend (ms)
+func observeTook(variant string, took int) {
+	backendQueryTook.WithLabelValues(variant).Observe(float64(took) / 1000)
+}
+
+// observeCorteza records latency of the Corteza API request
+// and counts failures
+func observeCorteza(endpoint string, start time.Time, err error) {
+	cortezaRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		cortezaRequestErrors.WithLabelValues(endpoint).Inc()
+	}
+}
@@ -0,0 +1,157 @@
+package searcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type (
+	// pagination holds paging parameters for the hits query
+	//
+	// When cursor is set, page is ignored and hits are fetched
+	// with search_after from the position encoded in the cursor.
+	pagination struct {
+		page    int
+		perPage int
+		cursor  *cursor
+	}
+
+	// cursor is an opaque (to the client) pointer to the first or last
+	// hit of a page; it holds sort values of that hit
+	cursor struct {
+		After   []json.RawMessage `json:"a"`
+		Reverse bool              `json:"r,omitempty"`
+	}
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+
+	// ES does not allow from+size to go over index.max_result_window
+	// (10k by default), cursor needs to be used for deeper pages
+	maxResultWindow = 10000
+)
+
+// hitsSort returns a stable sort for the hits query
+//
+// Hits are sorted by relevance, field with unique document ID is used as
+// a tiebreaker so that search_after can reliably continue where previous
+// page ended.
+//
+// Tiebreaker must exist in the mapping; with unmapped field all hits would
+// tie and pages would skip or repeat hits, so the query fails instead.
+func hitsSort(reverse bool, tiebreaker string) []interface{} {
+	score, id := "desc", "asc"
+	if reverse {
+		score, id = "asc", "desc"
+	}
+
+	return []interface{}{
+		map[string]string{"_score": score},
+		map[string]interface{}{tiebreaker: map[string]string{"order": id}},
+	}
+}
+
+// paging reads pagination parameters from the request
+//
+// Supports "page", "perPage" and "cursor" params; "size" is
+// still accepted as an alias for "perPage".
+func paging(r *http.Request) (p pagination, err error) {
+	p = pagination{page: 1, perPage: defaultPerPage}
+
+	if v := r.FormValue("page"); v != "" {
+		if p.page, err = strconv.Atoi(v); err != nil || p.page < 1 {
+			return p, fmt.Errorf("invalid page: %q", v)
+		}
+	}
+
+	perPage := r.FormValue("perPage")
+	if perPage == "" {
+		perPage = r.FormValue("size")
+	}
+
+	if perPage != "" {
+		if p.perPage, err = strconv.Atoi(perPage); err != nil || p.perPage < 1 {
+			return p, fmt.Errorf("invalid perPage: %q", perPage)
+		}
+
+		if p.perPage > maxPerPage {
+			p.perPage = maxPerPage
+		}
+	}
+
+	if v := r.FormValue("cursor"); v != "" {
+		if p.cursor, err = decodeCursor(v); err != nil {
+			return p, err
+		}
+
+		p.page = 0
+	} else if p.from()+p.perPage+1 > maxResultWindow {
+		// one hit more than requested is fetched to detect the next page
+		return p, fmt.Errorf("page out of range, use cursor to paginate beyond %d hits", maxResultWindow)
+	}
+
+	return p, nil
+}
+
+// from returns offset of the first hit on the page
+func (p pagination) from() int {
+	if p.page < 1 {
+		return 0
+	}
+
+	return (p.page - 1) * p.perPage
+}
+
+// cursors returns cursors pointing to the next and previous page
+//
+// Hits are expected to be in the natural (non-reversed) order and
+// hasMore to be set when there are more hits in the direction of the fetch.
+func (p pagination) cursors(hh []*esSearchHit, hasMore bool) (next, prev string) {
+	if len(hh) == 0 {
+		return
+	}
+
+	var (
+		reverse = p.cursor != nil && p.cursor.Reverse
+		first   = hh[0].Sort
+		last    = hh[len(hh)-1].Sort
+	)
+
+	if (!reverse && hasMore) || reverse {
+		next = (&cursor{After: last}).String()
+	}
+
+	if (reverse && hasMore) || (!reverse && (p.cursor != nil || p.page > 1)) {
+		prev = (&cursor{After: first, Reverse: true}).String()
+	}
+
+	return
+}
+
+// String encodes cursor into an URL safe string
+func (c *cursor) String() string {
+	enc, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(enc)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	var (
+		c        = &cursor{}
+		dec, err = base64.RawURLEncoding.DecodeString(s)
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	if err = json.Unmarshal(dec, c); err != nil || len(c.After) == 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return c, nil
+}
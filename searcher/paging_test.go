@@ -0,0 +1,113 @@
+package searcher
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCursorPaging(t *testing.T) {
+	var (
+		// all hits have the same score (no query), only the tiebreaker orders them
+		ids  = []string{"d5", "d1", "d7", "d3", "d2", "d6", "d4"}
+		docs strings.Builder
+	)
+
+	for i, id := range ids {
+		fmt.Fprintf(&docs, `{"_index":"corteza-public-compose-namespace","_id":%q,"_source":{"resourceType":"compose:namespace","name":"NS","handle":"h%d"}}`+"\n", id, len(ids)-i)
+	}
+
+	path := filepath.Join(t.TempDir(), "docs.ndjson")
+	if err := ioutil.WriteFile(path, []byte(docs.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch returns IDs of the hits on the page and cursors to the next and previous page
+	fetch := func(t *testing.T, b *embeddedBackend, cur string) (hh []string, next, prev string) {
+		t.Helper()
+
+		p := pagination{perPage: 2}
+		if cur != "" {
+			var err error
+			if p.cursor, err = decodeCursor(cur); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sr, err := b.search(context.Background(), searchParams{tier: tierPublic, paging: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, h := range sr.Hits.Hits {
+			hh = append(hh, h.ID)
+		}
+
+		next, prev = p.cursors(sr.Hits.Hits, sr.hasMore)
+		return
+	}
+
+	cases := []struct {
+		name       string
+		tiebreaker string
+		order      []string
+	}{
+		{"document ID", "_id", []string{"d1", "d2", "d3", "d4", "d5", "d6", "d7"}},
+		{"source field", "handle.keyword", []string{"d4", "d6", "d2", "d3", "d7", "d1", "d5"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := EmbeddedBackend(zap.NewNop(), path, c.tiebreaker)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				forward, backward []string
+				hh                []string
+				next, prev        string
+			)
+
+			for cur, pages := "", 0; pages == 0 || cur != ""; pages++ {
+				if pages > len(ids) {
+					t.Fatal("paging does not end")
+				}
+
+				hh, next, prev = fetch(t, b, cur)
+				forward = append(forward, hh...)
+				cur = next
+			}
+
+			if !reflect.DeepEqual(forward, c.order) {
+				t.Fatalf("expected every hit once in order %v, got %v", c.order, forward)
+			}
+
+			// walk back from the last page
+			for cur := prev; cur != ""; cur = prev {
+				hh, _, prev = fetch(t, b, cur)
+				backward = append(hh, backward...)
+			}
+
+			if expected := c.order[:len(c.order)-1]; !reflect.DeepEqual(backward, expected) {
+				t.Errorf("expected every hit before the last page once in order %v, got %v", expected, backward)
+			}
+		})
+	}
+
+	t.Run("unmapped tiebreaker", func(t *testing.T) {
+		b, err := EmbeddedBackend(zap.NewNop(), path, "id.keyword")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = b.search(context.Background(), searchParams{tier: tierPublic, paging: pagination{perPage: 2}}); err == nil {
+			t.Error("expected search to fail")
+		}
+	})
+}
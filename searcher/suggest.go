@@ -0,0 +1,255 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// corteza discovery suggestions
+	cdSuggestions struct {
+		Suggestions []cdSuggestion `json:"suggestions"`
+	}
+
+	cdSuggestion struct {
+		Type  string `json:"type"`
+		ID    string `json:"id,omitempty"`
+		Value string `json:"value"`
+
+		Namespace string `json:"namespace,omitempty"`
+		Module    string `json:"module,omitempty"`
+	}
+
+	suggestParams struct {
+		query string
+		limit int
+		tier  accessTier
+
+		// record fields visible to the user, indexed by "<namespaceID>-<moduleID>";
+		// record values are matched only in these fields
+		fields map[string][]string
+	}
+
+	// subset of the indexed document used for suggestions
+	suggestSource struct {
+		ResourceType string `json:"resourceType"`
+		Name         string `json:"name"`
+
+		Namespace struct {
+			Name        string `json:"name"`
+			NamespaceId uint64 `json:"namespaceId,string"`
+		} `json:"namespace"`
+		Module struct {
+			Name     string `json:"name"`
+			ModuleId uint64 `json:"moduleId,string"`
+		} `json:"module"`
+
+		Values map[string]interface{} `json:"values"`
+	}
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 25
+)
+
+// suggestFields are searched with prefix query, boosted by importance
+var suggestFields = []string{
+	"name^3",
+	"handle^2",
+}
+
+// suggestQuery builds prefix query over names and record values
+//
+// Record values are matched only in the fields visible to the user,
+// hidden values must not be revealed through suggestions
+func suggestQuery(ctx context.Context, p suggestParams) esSearchParams {
+	var (
+		query  = baseQuery(ctx, p.tier)
+		should = []interface{}{phrasePrefixQuery(p.query, suggestFields)}
+
+		// modules with the same visible fields share the clause
+		modules = make(map[string][]string)
+		fields  = make(map[string][]string)
+		sets    []string
+	)
+
+	for key, ff := range p.fields {
+		if len(ff) == 0 {
+			continue
+		}
+
+		set := strings.Join(ff, "\x00")
+		if _, has := fields[set]; !has {
+			sets = append(sets, set)
+			for _, f := range ff {
+				fields[set] = append(fields[set], valuesFieldPrefix+f)
+			}
+		}
+
+		modules[set] = append(modules[set], key[strings.Index(key, "-")+1:])
+	}
+
+	sort.Strings(sets)
+	for _, set := range sets {
+		sort.Strings(modules[set])
+		should = append(should, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"terms": map[string][]string{"module.moduleId.keyword": modules[set]}},
+				},
+				"must": []interface{}{phrasePrefixQuery(p.query, fields[set])},
+			},
+		})
+	}
+
+	query.Query.Bool.Must = append(query.Query.Bool.Must, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	})
+
+	query.Size = p.limit
+	query.Source = []string{"resourceType", "name", "namespace", "module", "values"}
+
+	return query
+}
+
+func phrasePrefixQuery(q string, fields []string) map[string]interface{} {
+	return map[string]interface{}{
+		"multi_match": map[string]interface{}{
+			"query":  q,
+			"type":   "phrase_prefix",
+			"fields": fields,
+			// values are of mixed types
+			"lenient": true,
+		},
+	}
+}
+
+// convSuggestions converts hits into short completions
+//
+// Record title is the first non-empty value of the fields configured
+// in the module's discovery meta; records without one are skipped.
+func convSuggestions(sr *esSearchResponse, moduleMeta map[string][]string) (out *cdSuggestions, err error) {
+	out = &cdSuggestions{Suggestions: []cdSuggestion{}}
+	seen := make(map[string]bool)
+
+	for _, h := range sr.Hits.Hits {
+		var (
+			src suggestSource
+			s   cdSuggestion
+		)
+
+		if err = json.Unmarshal(h.Source, &src); err != nil {
+			return
+		}
+
+		s = cdSuggestion{Type: src.ResourceType, ID: h.ID}
+
+		switch src.ResourceType {
+		case "compose:namespace":
+			s.Value = src.Name
+
+		case "compose:module":
+			s.Value = src.Name
+			s.Namespace = src.Namespace.Name
+
+		case "compose:record":
+			key := fmt.Sprintf("%d-%d", src.Namespace.NamespaceId, src.Module.ModuleId)
+			s.Value = recordTitle(src.Values, moduleMeta[key])
+			s.Namespace = src.Namespace.Name
+			s.Module = src.Module.Name
+
+		default:
+			continue
+		}
+
+		if s.Value == "" || seen[s.Type+s.Value] {
+			continue
+		}
+
+		seen[s.Type+s.Value] = true
+		out.Suggestions = append(out.Suggestions, s)
+	}
+
+	return
+}
+
+func recordTitle(values map[string]interface{}, fields []string) string {
+	for _, f := range fields {
+		v := values[f]
+		if vv, ok := v.([]interface{}); ok {
+			if len(vv) == 0 {
+				continue
+			}
+			v = vv[0]
+		}
+
+		if str := strings.TrimSpace(cast.ToString(v)); str != "" {
+			return str
+		}
+	}
+
+	return ""
+}
+
+// Suggest returns search-as-you-type completions
+func (h handlers) Suggest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var (
+		ctx  = r.Context()
+		tier = accessTierFor(ctx, h.opt.ProtectedRoles)
+		p    = suggestParams{
+			query: strings.TrimSpace(r.FormValue("q")),
+			limit: defaultSuggestLimit,
+			tier:  tier,
+		}
+
+		sr  = &esSearchResponse{}
+		err error
+	)
+
+	if v := r.FormValue("limit"); v != "" {
+		if p.limit, err = strconv.Atoi(v); err != nil || p.limit < 1 {
+			writeError(w, errBadRequest(fmt.Errorf("invalid limit: %q", v)))
+			return
+		}
+
+		if p.limit > maxSuggestLimit {
+			p.limit = maxSuggestLimit
+		}
+	}
+
+	// without metadata record values are not matched
+	if meta, err := h.meta.get(); err != nil {
+		h.log.Error("failed to load metadata", zap.Error(err))
+	} else {
+		_, roles := identity(ctx)
+		p.fields = meta.resultFields(tier, roles, 0)
+	}
+
+	if p.query != "" {
+		if sr, err = h.backend.Suggest(ctx, p); err != nil {
+			h.log.Error("could not execute suggest search", zap.Error(err))
+			writeError(w, errBackend(err))
+			return
+		}
+	}
+
+	if out, err := convSuggestions(sr, p.fields); err != nil {
+		h.log.Error("could not convert suggestions", zap.Error(err))
+		writeError(w, errBackend(err))
+	} else if err = json.NewEncoder(w).Encode(out); err != nil {
+		h.log.Error("could not encode response body", zap.Error(err))
+	}
+}
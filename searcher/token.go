@@ -0,0 +1,177 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// tokenSource obtains access token with client credentials and keeps it fresh
+	//
+	// Token is refreshed ahead of its expiry; concurrent refreshes
+	// are deduplicated and share the result
+	tokenSource struct {
+		client *http.Client
+
+		uri    string
+		key    string
+		secret string
+
+		// how long before the expiry token is refreshed
+		margin time.Duration
+
+		mux       sync.RWMutex
+		token     string
+		refreshAt time.Time
+		expiresAt time.Time
+
+		group singleflight.Group
+	}
+
+	tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+)
+
+// Token returns valid access token
+//
+// When refresh ahead of the expiry fails, current token is
+// returned for as long as it is valid
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	s.mux.RLock()
+	token, refreshAt, expiresAt := s.token, s.refreshAt, s.expiresAt
+	s.mux.RUnlock()
+
+	now := time.Now()
+	if token != "" && now.Before(refreshAt) {
+		return token, nil
+	}
+
+	fresh, err := s.refresh(ctx, token)
+	if err != nil && token != "" && now.Before(expiresAt) {
+		return token, nil
+	}
+
+	return fresh, err
+}
+
+// Invalidate forces refresh of the token that was rejected
+//
+// Token that was already replaced is not refreshed again
+func (s *tokenSource) Invalidate(token string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.token == token {
+		s.refreshAt, s.expiresAt = time.Time{}, time.Time{}
+	}
+}
+
+// refresh fetches new token unless stale one was replaced in the meantime
+func (s *tokenSource) refresh(ctx context.Context, stale string) (string, error) {
+	ch := s.group.DoChan("token", func() (interface{}, error) {
+		s.mux.RLock()
+		token, refreshAt := s.token, s.refreshAt
+		s.mux.RUnlock()
+
+		if token != stale && time.Now().Before(refreshAt) {
+			return token, nil
+		}
+
+		// shared by all callers; not canceled with the one that started it
+		rsp, err := s.fetch(context.Background())
+		if err != nil {
+			tokenRefreshes.WithLabelValues("error").Inc()
+			return nil, err
+		}
+
+		tokenRefreshes.WithLabelValues("success").Inc()
+
+		var (
+			now      = time.Now()
+			lifetime = time.Duration(rsp.ExpiresIn) * time.Second
+			margin   = s.margin
+		)
+
+		// short-lived tokens are refreshed in the second half of their lifetime
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+
+		s.mux.Lock()
+		s.token = rsp.AccessToken
+		s.expiresAt = now.Add(lifetime)
+		s.refreshAt = s.expiresAt.Add(-margin)
+		s.mux.Unlock()
+
+		return rsp.AccessToken, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+
+		return res.Val.(string), nil
+	}
+}
+
+func (s *tokenSource) fetch(ctx context.Context) (out *tokenResponse, err error) {
+	defer func(start time.Time) { observeCorteza("token", start, err) }(time.Now())
+
+	var (
+		req  *http.Request
+		rsp  *http.Response
+		form = url.Values{}
+	)
+
+	if s.key == "" || s.secret == "" {
+		return nil, fmt.Errorf("missing client credentials")
+	}
+
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", "profile api discovery")
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+
+	req.SetBasicAuth(s.key, s.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if rsp, err = s.client.Do(req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	defer rsp.Body.Close()
+
+	out = &tokenResponse{}
+	if err = json.NewDecoder(rsp.Body).Decode(out); err != nil && rsp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	switch {
+	case rsp.StatusCode != http.StatusOK && out.Error != "":
+		return nil, fmt.Errorf("can not authenticate: %s", out.Error)
+	case rsp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("can not authenticate, unexpected status: %s", rsp.Status)
+	case out.AccessToken == "":
+		return nil, fmt.Errorf("can not authenticate, no access token in response")
+	}
+
+	return out, nil
+}
@@ -0,0 +1,145 @@
+package searcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+type (
+	// TracingOptions configure OpenTelemetry tracing
+	//
+	// Exporter is configured with the standard OTEL_EXPORTER_OTLP_* variables
+	TracingOptions struct {
+		ServiceName string
+
+		// fraction of the traces (that are not sampled by the caller) to sample
+		SampleRatio float64
+	}
+
+	// tracedTransport creates client span for each request and
+	// propagates trace context to the server
+	tracedTransport struct {
+		base http.RoundTripper
+
+		// set X-Opaque-Id (Elasticsearch tasks and slow logs)
+		opaqueID bool
+	}
+)
+
+const (
+	tracerName = "github.com/cortezaproject/corteza-discovery-searcher/searcher"
+
+	requestIDKey = attribute.Key("request.id")
+)
+
+// InitTracing sets up global tracer provider with OTLP exporter
+//
+// Returned function flushes and stops the exporter
+func InitTracing(ctx context.Context, opt TracingOptions) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opt.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(opt.ServiceName))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
+
+// startSpan starts internal span with the searcher's tracer
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records error (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traceRequests creates server span for each request
+//
+// Trace context from the caller is continued and
+// request ID (from the RequestID middleware) is attached
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.NetAttributesFromHTTPRequest("tcp", r)...),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path)),
+		)
+		defer span.End()
+
+		if id := middleware.GetReqID(ctx); id != "" {
+			span.SetAttributes(requestIDKey.String(id))
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName("HTTP " + r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+		}
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(code)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(code))
+	})
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (rsp *http.Response, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+	defer func() { endSpan(span, err) }()
+
+	// request must not be modified
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if t.opaqueID && req.Header.Get("X-Opaque-Id") == "" {
+		if id := middleware.GetReqID(ctx); id != "" {
+			req.Header.Set("X-Opaque-Id", id)
+		} else if span.SpanContext().HasTraceID() {
+			req.Header.Set("X-Opaque-Id", span.SpanContext().TraceID().String())
+		}
+	}
+
+	if rsp, err = t.base.RoundTrip(req); err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(rsp.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(rsp.StatusCode))
+	return rsp, nil
+}
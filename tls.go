@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// certReloader serves certificate from the files and
+	// reloads it when files are changed (renewed)
+	certReloader struct {
+		log      *zap.Logger
+		certFile string
+		keyFile  string
+
+		mux     sync.RWMutex
+		cert    *tls.Certificate
+		modTime time.Time
+	}
+)
+
+const (
+	// how often certificate files are checked for changes
+	certReloadInterval = 10 * time.Second
+)
+
+// serverTLSConfig returns TLS configuration for the HTTP server
+// or nil when TLS is not configured
+func serverTLSConfig(ctx context.Context, log *zap.Logger, cfg *config) (*tls.Config, error) {
+	if cfg.http.tlsCert == "" {
+		return nil, nil
+	}
+
+	cr := &certReloader{
+		log:      log.Named("tls"),
+		certFile: cfg.http.tlsCert,
+		keyFile:  cfg.http.tlsKey,
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	go cr.watch(ctx)
+
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+
+	if cfg.http.tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.http.tlsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA certificate: %w", err)
+		}
+
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", cfg.http.tlsClientCA)
+		}
+
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if cfg.http.tlsClientOptional {
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tc, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mux.RLock()
+	defer cr.mux.RUnlock()
+	return cr.cert, nil
+}
+
+// load reads certificate and key from the files
+func (cr *certReloader) load() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %w", err)
+	}
+
+	cr.mux.Lock()
+	cr.cert, cr.modTime = &cert, modTime
+	cr.mux.Unlock()
+
+	return nil
+}
+
+// watch reloads certificate when any of the files is modified
+//
+// Function blocks until context is done
+func (cr *certReloader) watch(ctx context.Context) {
+	t := time.NewTicker(certReloadInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			modTime, err := cr.lastModified()
+			if err != nil {
+				cr.log.Warn("could not check certificate files", zap.Error(err))
+				continue
+			}
+
+			cr.mux.RLock()
+			changed := modTime.After(cr.modTime)
+			cr.mux.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			// keep the old certificate when new one can not be loaded
+			// (files are probably not written completely)
+			if err = cr.load(); err != nil {
+				cr.log.Warn("could not reload certificate", zap.Error(err))
+				continue
+			}
+
+			cr.log.Info("certificate reloaded", zap.String("cert", cr.certFile))
+		}
+	}
+}
+
+// lastModified returns latest modification time of the certificate and key files
+func (cr *certReloader) lastModified() (t time.Time, err error) {
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return t, fmt.Errorf("could not stat %s: %w", path, err)
+		}
+
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+
+	return t, nil
+}